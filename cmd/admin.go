@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminServers serves the metrics and health endpoints. Endpoints
+// given the same address share a server.
+type adminServers map[string]*http.ServeMux
+
+func (a adminServers) handle(addr, pattern string, handler http.Handler) {
+	if addr == "" {
+		return
+	}
+	mux, ok := a[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		a[addr] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// start serves each address in the background.
+func (a adminServers) start() {
+	for addr, mux := range a {
+		go func(addr string, mux *http.ServeMux) {
+			logrus.WithField("addr", addr).Info("Serving admin endpoints")
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logrus.WithError(err).WithField("addr", addr).Error("Admin server stopped")
+			}
+		}(addr, mux)
+	}
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+)
+
+// statement is a SQL statement with its parameters.
+type statement struct {
+	sql    string
+	params []interface{}
+}
+
+// txBeginner is satisfied by *sql.DB and *sql.Conn.
+type txBeginner interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// execBatch executes the statements in a single transaction, so that
+// they all take effect or none do and the batch can be safely retried.
+// It returns the result of the first statement.
+func execBatch(ctx context.Context, db txBeginner, statements []statement) (sql.Result, error) {
+	if len(statements) == 1 {
+		return db.ExecContext(ctx, statements[0].sql, statements[0].params...)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var first sql.Result
+	for i, stmt := range statements {
+		result, err := tx.ExecContext(ctx, stmt.sql, stmt.params...)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if i == 0 {
+			first = result
+		}
+	}
+
+	return first, tx.Commit()
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/spf13/cobra"
+)
+
+const createCheckpointTableSQL = "CREATE TABLE IF NOT EXISTS `naveego_checkpoints` (\n" +
+	"\t`publisher` VARCHAR(255) NOT NULL,\n" +
+	"\t`shape` VARCHAR(255) NOT NULL,\n" +
+	"\t`published_at` DATETIME(6) NULL,\n" +
+	"\t`row_count` BIGINT NOT NULL DEFAULT 0,\n" +
+	"\t`updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,\n" +
+	"\tPRIMARY KEY (`publisher`, `shape`)\n" +
+	")"
+
+const upsertCheckpointSQL = "INSERT INTO `naveego_checkpoints` (`publisher`, `shape`, `published_at`, `row_count`)\n" +
+	"\tVALUES (?, ?, ?, 1)\n" +
+	"\tON DUPLICATE KEY UPDATE\n" +
+	"\t\t`published_at` = COALESCE(GREATEST(`published_at`, VALUES(`published_at`)), `published_at`, VALUES(`published_at`)),\n" +
+	"\t\t`row_count` = `row_count` + 1"
+
+// checkpointTimeFormat keeps the microseconds of publishedAt.
+const checkpointTimeFormat = "2006-01-02 15:04:05.000000"
+
+const selectCheckpointsSQL = "SELECT `publisher`, `shape`, `published_at`, `row_count`, `updated_at` FROM `naveego_checkpoints`\n" +
+	"\tWHERE (? = '' OR `publisher` = ?) AND (? = '' OR `shape` = ?)\n" +
+	"\tORDER BY `publisher`, `shape`"
+
+// checkpoint is how far delivery from a publisher for a shape has got.
+type checkpoint struct {
+	Publisher   string    `json:"publisher"`
+	Shape       string    `json:"shape"`
+	PublishedAt string    `json:"publishedAt"`
+	Count       int64     `json:"count"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// checkpointStatement returns the statement advancing the checkpoint for a data point.
+// It is executed in the same transaction as the data point's upsert. A data point
+// without a valid publishedAt only adds to the count.
+func checkpointStatement(opts *sqlOptions, shape string, dp pipeline.DataPoint) statement {
+	publisher, ok := dp.Meta["publisher"]
+	if !ok {
+		publisher = "UNKNOWN"
+	}
+
+	var publishedAt interface{}
+	if t, ok := opts.Dates.parse(dp.Meta["publishedAt"]); ok {
+		publishedAt = t.UTC().Format(checkpointTimeFormat)
+	}
+
+	return statement{
+		sql:    upsertCheckpointSQL,
+		params: []interface{}{publisher, shape, publishedAt},
+	}
+}
+
+// readCheckpoints returns the checkpoints, optionally only for one publisher or shape.
+// The times are read whether or not the connection has parseTime set.
+func readCheckpoints(db *sql.DB, publisher, shape string) ([]checkpoint, error) {
+	rows, err := db.Query(selectCheckpointsSQL, publisher, publisher, shape, shape)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []checkpoint{}
+	for rows.Next() {
+		var (
+			c           checkpoint
+			publishedAt mysql.NullTime
+			updatedAt   mysql.NullTime
+		)
+		if err = rows.Scan(&c.Publisher, &c.Shape, &publishedAt, &c.Count, &updatedAt); err != nil {
+			return nil, err
+		}
+		if publishedAt.Valid {
+			c.PublishedAt = publishedAt.Time.UTC().Format(checkpointTimeFormat)
+		}
+		c.UpdatedAt = updatedAt.Time
+		checkpoints = append(checkpoints, c)
+	}
+
+	return checkpoints, rows.Err()
+}
+
+var checkpointsFlags = &settingsFlags{}
+var checkpointsPublisher, checkpointsShape string
+
+var checkpointsCmd = &cobra.Command{
+	Use:   "checkpoints",
+	Short: "Prints where delivery should resume from, for each publisher and shape",
+	Long: `Prints the checkpoints kept in the naveego_checkpoints table as JSON.
+Each checkpoint has the highest publishedAt committed for a publisher and shape,
+and the number of data points committed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		settingsMap, err := checkpointsFlags.load()
+		if err != nil {
+			return err
+		}
+
+		s, err := decodeSettings(settingsMap)
+		if err != nil {
+			return err
+		}
+
+		conn, err := openConnection(s)
+		if err != nil {
+			return err
+		}
+		defer conn.close()
+
+		checkpoints, err := readCheckpoints(conn.db, checkpointsPublisher, checkpointsShape)
+		if err != nil {
+			return fmt.Errorf("couldn't read checkpoints: %s", err)
+		}
+
+		return printJSON(os.Stdout, checkpoints)
+	},
+}
+
+func init() {
+	checkpointsFlags.register(checkpointsCmd)
+	checkpointsCmd.Flags().StringVar(&checkpointsPublisher, "publisher", "", "only print checkpoints for this publisher")
+	checkpointsCmd.Flags().StringVar(&checkpointsShape, "shape", "", "only print checkpoints for this shape")
+	RootCmd.AddCommand(checkpointsCmd)
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckpointStatement(t *testing.T) {
+
+	Convey("Given a data point with a publisher and publishedAt", t, func() {
+		dp := pipeline.DataPoint{
+			Meta: map[string]string{
+				"publisher":   "pub-1",
+				"publishedAt": "2017-10-11T12:13:14.123456Z",
+			},
+		}
+
+		Convey("Then the checkpoint should keep the publishedAt to the microsecond", func() {
+			stmt := checkpointStatement(defaultOptions, "Test.Products", dp)
+			So(stmt.sql, ShouldEqual, upsertCheckpointSQL)
+			So(stmt.params, ShouldResemble, []interface{}{"pub-1", "Test.Products", "2017-10-11 12:13:14.123456"})
+		})
+	})
+
+	Convey("Given a data point without metadata", t, func() {
+		dp := pipeline.DataPoint{}
+
+		Convey("Then the checkpoint should only be counted", func() {
+			stmt := checkpointStatement(defaultOptions, "Test.Products", dp)
+			So(stmt.params, ShouldResemble, []interface{}{"UNKNOWN", "Test.Products", nil})
+		})
+	})
+}
+
+func TestReadCheckpoints(t *testing.T) {
+
+	Convey("Given checkpoints in the database", t, func() {
+		db, fake := newFakeDB()
+		defer db.Close()
+
+		updatedAt := time.Date(2019, 10, 18, 9, 30, 0, 0, time.UTC)
+		publishedAt := time.Date(2019, 10, 18, 9, 29, 59, 123456000, time.UTC)
+		columns := []string{"publisher", "shape", "published_at", "row_count", "updated_at"}
+
+		expected := []checkpoint{
+			{Publisher: "pub-1", Shape: "Test.Products", PublishedAt: "2019-10-18 09:29:59.123456", Count: 3, UpdatedAt: updatedAt},
+			{Publisher: "pub-2", Shape: "Test.Products", Count: 1, UpdatedAt: updatedAt},
+		}
+
+		Convey("When the connection returns times as text", func() {
+			fake.rows = func(string) ([]string, [][]driver.Value) {
+				return columns, [][]driver.Value{
+					{[]byte("pub-1"), []byte("Test.Products"), []byte("2019-10-18 09:29:59.123456"), int64(3), []byte("2019-10-18 09:30:00")},
+					{[]byte("pub-2"), []byte("Test.Products"), nil, int64(1), []byte("2019-10-18 09:30:00")},
+				}
+			}
+
+			Convey("Then the checkpoints should be read", func() {
+				checkpoints, err := readCheckpoints(db, "", "")
+				So(err, ShouldBeNil)
+				So(checkpoints, ShouldResemble, expected)
+			})
+		})
+
+		Convey("When the connection has parseTime set", func() {
+			fake.rows = func(string) ([]string, [][]driver.Value) {
+				return columns, [][]driver.Value{
+					{[]byte("pub-1"), []byte("Test.Products"), publishedAt, int64(3), updatedAt},
+					{[]byte("pub-2"), []byte("Test.Products"), nil, int64(1), updatedAt},
+				}
+			}
+
+			Convey("Then the checkpoints should be read the same way", func() {
+				checkpoints, err := readCheckpoints(db, "", "")
+				So(err, ShouldBeNil)
+				So(checkpoints, ShouldResemble, expected)
+			})
+		})
+	})
+
+	Convey("Given checkpoints and parallel writes", t, func() {
+		s := &settings{DataSourceName: "user:password@tcp(localhost:3306)/db", Checkpoints: true, ParallelWrites: true}
+
+		Convey("Then one writer per shape should be allowed", func() {
+			So(s.validate(), ShouldBeNil)
+		})
+
+		Convey("Then several writers per shape should be refused, as they commit out of order", func() {
+			s.WriterShards = 2
+			So(s.validate(), ShouldResemble, settingsError{"checkpoints", "can't be kept with more than one writer per shape"})
+		})
+	})
+}
+
+func TestExecBatch(t *testing.T) {
+
+	Convey("Given a database", t, func() {
+		db, fake := newFakeDB()
+		defer db.Close()
+
+		statements := []statement{
+			{sql: "UPSERT", params: []interface{}{"a"}},
+			{sql: upsertCheckpointSQL, params: []interface{}{"pub", "shape", nil}},
+		}
+
+		Convey("When a batch succeeds", func() {
+			_, err := execBatch(context.Background(), db, statements)
+
+			Convey("Then all statements should be executed in order", func() {
+				So(err, ShouldBeNil)
+				execs := fake.executed()
+				So(len(execs), ShouldEqual, 2)
+				So(execs[0].query, ShouldEqual, "UPSERT")
+				So(execs[1].query, ShouldEqual, upsertCheckpointSQL)
+			})
+		})
+
+		Convey("When the checkpoint fails", func() {
+			fake.fail = func(query string, args []driver.Value) error {
+				if query == upsertCheckpointSQL {
+					return errors.New("boom")
+				}
+				return nil
+			}
+
+			_, err := execBatch(context.Background(), db, statements)
+
+			Convey("Then the batch should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestSettingsFlags(t *testing.T) {
+
+	Convey("Given settings flags", t, func() {
+
+		Convey("When neither a file nor a DSN is given", func() {
+			_, err := (&settingsFlags{}).load()
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a file and a DSN are given", func() {
+			f, _ := ioutil.TempFile("", "settings")
+			defer os.Remove(f.Name())
+			f.WriteString(`{"host": "db", "dataSourceName": "old"}`)
+			f.Close()
+
+			settingsMap, err := (&settingsFlags{file: f.Name(), dsn: "user:pass@tcp(db:3306)/test"}).load()
+
+			Convey("Then the DSN should override the file", func() {
+				So(err, ShouldBeNil)
+				So(settingsMap["host"], ShouldEqual, "db")
+				So(settingsMap["dataSourceName"], ShouldEqual, "user:pass@tcp(db:3306)/test")
+			})
+		})
+	})
+}
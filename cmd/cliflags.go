@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+)
+
+// settingsFlags are the flags subcommands take to get the plugin settings:
+// a JSON file with the same settings Init receives, a data source name, or both.
+type settingsFlags struct {
+	file string
+	dsn  string
+}
+
+func (f *settingsFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.file, "settings", "", "path to a JSON file with the plugin settings")
+	cmd.Flags().StringVar(&f.dsn, "dsn", "", "data source name (user:password@tcp(host:port)/database); overrides the settings file")
+}
+
+// load returns the settings map from the flags.
+func (f *settingsFlags) load() (map[string]interface{}, error) {
+	settingsMap := map[string]interface{}{}
+
+	if f.file != "" {
+		data, err := ioutil.ReadFile(f.file)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read settings file: %s", err)
+		}
+		if err = json.Unmarshal(data, &settingsMap); err != nil {
+			return nil, fmt.Errorf("couldn't parse settings file %s: %s", f.file, err)
+		}
+	}
+
+	if f.dsn != "" {
+		settingsMap["dataSourceName"] = f.dsn
+	}
+
+	if len(settingsMap) == 0 {
+		return nil, errors.New("either --settings or --dsn is required")
+	}
+
+	return settingsMap, nil
+}
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// How strictly values are converted to their column's type.
+const (
+	// coercionLenient converts numeric strings, boolean spellings, and numbers
+	// and booleans for text columns. It's the default.
+	coercionLenient = "lenient"
+	// coercionStrict only accepts values which are already of the column's kind.
+	coercionStrict = "strict"
+	// coercionOff sends values as they arrive and lets the server convert them.
+	coercionOff = "off"
+)
+
+// coercer converts value for a column. It returns the reason when value can't be
+// converted, without the value, which is customer data.
+type coercer func(value interface{}, lenient bool) (interface{}, string)
+
+// coercers are keyed by the column type without its size.
+var coercers = map[string]coercer{
+	"TINYINT":   integerCoercer(8, false),
+	"SMALLINT":  integerCoercer(16, false),
+	"MEDIUMINT": integerCoercer(24, false),
+	"INT":       integerCoercer(32, false),
+	"INTEGER":   integerCoercer(32, false),
+	"BIGINT":    integerCoercer(64, false),
+	"FLOAT":     coerceFloat,
+	"DOUBLE":    coerceFloat,
+	"DECIMAL":   coerceDecimal,
+	"NUMERIC":   coerceDecimal,
+	"BIT":       coerceBool,
+	"CHAR":      coerceString,
+	"VARCHAR":   coerceString,
+	"TEXT":      coerceString,
+	"LONGTEXT":  coerceString,
+}
+
+// unsignedCoercers replace coercers for UNSIGNED integer columns.
+var unsignedCoercers = map[string]coercer{
+	"TINYINT":   integerCoercer(8, true),
+	"SMALLINT":  integerCoercer(16, true),
+	"MEDIUMINT": integerCoercer(24, true),
+	"INT":       integerCoercer(32, true),
+	"INTEGER":   integerCoercer(32, true),
+	"BIGINT":    integerCoercer(64, true),
+}
+
+// coerceValue converts value for a column of type t, using the coercer for t if there is one.
+func (o *sqlOptions) coerceValue(t string, value interface{}) (interface{}, string) {
+	if value == nil || o.Coercion == coercionOff {
+		return value, ""
+	}
+
+	c, ok := coercers[baseSQLType(t)]
+	if strings.Contains(strings.ToUpper(t), "UNSIGNED") {
+		if unsigned, isInteger := unsignedCoercers[baseSQLType(t)]; isInteger {
+			c = unsigned
+		}
+	}
+	if !ok {
+		return value, ""
+	}
+	return c(value, o.Coercion != coercionStrict)
+}
+
+// baseSQLType returns t without its size or attributes, e.g. INT for "INT(10) UNSIGNED".
+func baseSQLType(t string) string {
+	t = strings.ToUpper(t)
+	if i := strings.IndexAny(t, "( "); i >= 0 {
+		t = t[:i]
+	}
+	return t
+}
+
+func integerCoercer(bits uint, unsigned bool) coercer {
+	min, max := -math.Pow(2, float64(bits-1)), math.Pow(2, float64(bits-1))-1
+	column := map[uint]string{8: "a TINYINT", 16: "a SMALLINT", 24: "a MEDIUMINT", 32: "an INT", 64: "a BIGINT"}[bits]
+	if unsigned {
+		min, max = 0, math.Pow(2, float64(bits))-1
+		column += " UNSIGNED"
+	}
+
+	// parse reads s exactly when it's an integer; float64 loses precision above 2^53.
+	parse := func(s string) (interface{}, float64, bool) {
+		if unsigned {
+			if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return n, float64(n), true
+			}
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, float64(n), true
+		}
+		return nil, 0, false
+	}
+
+	inRange := func(n float64) string {
+		if n != math.Trunc(n) {
+			return fmt.Sprintf("a number with a fractional part for %s column", column)
+		}
+		if n < min || n > max {
+			return fmt.Sprintf("out of range for %s column", column)
+		}
+		return ""
+	}
+
+	return func(value interface{}, lenient bool) (interface{}, string) {
+		switch v := value.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			n, _ := strconv.ParseFloat(fmt.Sprint(v), 64)
+			return value, inRange(n)
+		case float64:
+			return value, inRange(v)
+		case float32:
+			return value, inRange(float64(v))
+		case json.Number:
+			n, f, ok := parse(v.String())
+			if !ok {
+				return nil, fmt.Sprintf("not an integer for %s column", column)
+			}
+			return n, inRange(f)
+		case bool:
+			if lenient {
+				return boolToInt(v), ""
+			}
+		case string:
+			if lenient {
+				s := strings.TrimSpace(v)
+				if n, f, ok := parse(s); ok {
+					return n, inRange(f)
+				}
+				if n, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(n, 0) && !math.IsNaN(n) {
+					if reason := inRange(n); reason != "" {
+						return nil, reason
+					}
+					return int64(n), ""
+				}
+				return nil, fmt.Sprintf("a string which isn't a number for %s column", column)
+			}
+		}
+		return nil, fmt.Sprintf("%s for %s column", kindOf(value), column)
+	}
+}
+
+func coerceFloat(value interface{}, lenient bool) (interface{}, string) {
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32:
+		return value, ""
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, "not a finite number for a numeric column"
+		}
+		return value, ""
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			return nil, "not a number for a numeric column"
+		}
+		return n, ""
+	case bool:
+		if lenient {
+			return boolToInt(v), ""
+		}
+	case string:
+		if lenient {
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+				return nil, "a string which isn't a number for a numeric column"
+			}
+			return n, ""
+		}
+	}
+	return nil, fmt.Sprintf("%s for a numeric column", kindOf(value))
+}
+
+// decimalPattern matches the numbers a DECIMAL column accepts as text.
+var decimalPattern = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// coerceDecimal passes numbers written as text through as text, so the server
+// rounds them to the column's scale exactly instead of through a float64.
+func coerceDecimal(value interface{}, lenient bool) (interface{}, string) {
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32:
+		return value, ""
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, "not a finite number for a DECIMAL column"
+		}
+		return value, ""
+	case json.Number:
+		if !decimalPattern.MatchString(v.String()) {
+			return nil, "not a number for a DECIMAL column"
+		}
+		return v.String(), ""
+	case bool:
+		if lenient {
+			return boolToInt(v), ""
+		}
+	case string:
+		if lenient {
+			s := strings.TrimSpace(v)
+			if !decimalPattern.MatchString(s) {
+				return nil, "a string which isn't a number for a DECIMAL column"
+			}
+			return s, ""
+		}
+	}
+	return nil, fmt.Sprintf("%s for a DECIMAL column", kindOf(value))
+}
+
+func coerceBool(value interface{}, lenient bool) (interface{}, string) {
+	switch v := value.(type) {
+	case bool:
+		return v, ""
+	case string:
+		if lenient {
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "t", "yes", "y", "on", "1":
+				return true, ""
+			case "false", "f", "no", "n", "off", "0":
+				return false, ""
+			}
+			return nil, "a string which isn't a boolean for a BIT column"
+		}
+	case int, int64, float64, json.Number:
+		if lenient {
+			switch fmt.Sprint(v) {
+			case "1":
+				return true, ""
+			case "0":
+				return false, ""
+			}
+			return nil, "a number other than 0 or 1 for a BIT column"
+		}
+	}
+	return nil, fmt.Sprintf("%s for a BIT column", kindOf(value))
+}
+
+func coerceString(value interface{}, lenient bool) (interface{}, string) {
+	switch v := value.(type) {
+	case string:
+		return v, ""
+	case float64:
+		if lenient {
+			return strconv.FormatFloat(v, 'f', -1, 64), ""
+		}
+	case int, int64, json.Number, bool:
+		if lenient {
+			return fmt.Sprint(v), ""
+		}
+	case map[string]interface{}, []interface{}:
+		if lenient {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, "an object which can't be written as JSON"
+			}
+			return string(b), ""
+		}
+	}
+	return nil, fmt.Sprintf("%s for a text column", kindOf(value))
+}
+
+// kindOf describes the JSON kind of value for error messages, e.g. "a string".
+func kindOf(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+		return "a number"
+	}
+	return fmt.Sprintf("a %T", value)
+}
+
+// valueErrors are the values of a data point which couldn't be converted, one for each column.
+type valueErrors []*valueError
+
+func (e valueErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// isValueError reports whether err is about values which couldn't be converted.
+func isValueError(err error) bool {
+	switch err.(type) {
+	case *valueError, valueErrors:
+		return true
+	}
+	return false
+}
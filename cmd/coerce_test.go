@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValueCoercion(t *testing.T) {
+
+	Convey("Given lenient coercion", t, func() {
+		opts := &sqlOptions{InvalidValuePolicy: invalidValueError}
+
+		format := func(sqlType string, value interface{}) interface{} {
+			v, err := formatValue(nil, opts, "col", sqlType, value)
+			So(err, ShouldBeNil)
+			return v
+		}
+		reason := func(sqlType string, value interface{}) string {
+			_, err := formatValue(nil, opts, "col", sqlType, value)
+			So(err, ShouldNotBeNil)
+			return err.(*valueError).Reason
+		}
+
+		Convey("Then numeric strings should be converted for numeric columns", func() {
+			So(format("INT(10)", " 42 "), ShouldEqual, int64(42))
+			So(format("INT(10)", "42.0"), ShouldEqual, int64(42))
+			So(format("FLOAT", "4.5"), ShouldEqual, 4.5)
+			So(format("INT(10)", json.Number("7")), ShouldEqual, int64(7))
+			So(format("INT(10)", 42.0), ShouldEqual, 42.0)
+		})
+
+		Convey("Then boolean spellings should be converted for BIT columns", func() {
+			So(format("BIT", "yes"), ShouldEqual, true)
+			So(format("BIT", "Off"), ShouldEqual, false)
+			So(format("BIT", 1.0), ShouldEqual, true)
+		})
+
+		Convey("Then numbers, booleans and objects should be converted for text columns", func() {
+			So(format("VARCHAR(1000)", 42.5), ShouldEqual, "42.5")
+			So(format("VARCHAR(1000)", true), ShouldEqual, "true")
+			So(format("TEXT", map[string]interface{}{"a": 1.0}), ShouldEqual, `{"a":1}`)
+		})
+
+		Convey("Then numbers should be converted for date columns", func() {
+			So(format("DATETIME", 1507723994.0), ShouldEqual, "2017-10-11 12:13:14")
+		})
+
+		Convey("Then values which can't be converted should be reported", func() {
+			So(reason("INT(10)", "forty two"), ShouldEqual, "a string which isn't a number for an INT column")
+			So(reason("INT(10)", 4.5), ShouldEqual, "a number with a fractional part for an INT column")
+			So(reason("INT(10)", 3e9), ShouldEqual, "out of range for an INT column")
+			So(reason("BIT", "maybe"), ShouldEqual, "a string which isn't a boolean for a BIT column")
+			So(reason("FLOAT", []interface{}{}), ShouldEqual, "an array for a numeric column")
+		})
+
+		Convey("Then integers should keep their precision in BIGINT columns", func() {
+			So(format("BIGINT(20)", "3000000000"), ShouldEqual, int64(3000000000))
+			So(format("BIGINT(20)", json.Number("9007199254740993")), ShouldEqual, int64(9007199254740993))
+		})
+
+		Convey("Then the range of unsigned columns should be used", func() {
+			So(format("INT(10) UNSIGNED", "3000000000"), ShouldEqual, uint64(3000000000))
+			So(format("BIGINT(20) UNSIGNED", json.Number("18446744073709551615")), ShouldEqual, uint64(18446744073709551615))
+			So(reason("INT(10) UNSIGNED", -1.0), ShouldEqual, "out of range for an INT UNSIGNED column")
+		})
+
+		Convey("Then decimal text should be passed through for DECIMAL columns", func() {
+			So(format("DECIMAL(30,10)", "12345678901234567890.0123456789"), ShouldEqual, "12345678901234567890.0123456789")
+			So(format("DECIMAL(30,10)", json.Number("0.1000000000000000055")), ShouldEqual, "0.1000000000000000055")
+			So(reason("DECIMAL(10,2)", "12,50"), ShouldEqual, "a string which isn't a number for a DECIMAL column")
+		})
+	})
+
+	Convey("Given strict coercion", t, func() {
+		opts := &sqlOptions{InvalidValuePolicy: invalidValueError, Coercion: coercionStrict}
+
+		Convey("Then only values of the column's kind should be accepted", func() {
+			v, err := formatValue(nil, opts, "col", "INT(10)", 42.0)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, 42.0)
+
+			_, err = formatValue(nil, opts, "col", "INT(10)", "42")
+			So(err, ShouldResemble, &valueError{Column: "col", Reason: "a string for an INT column"})
+
+			_, err = formatValue(nil, opts, "col", "VARCHAR(255)", 42.0)
+			So(err, ShouldResemble, &valueError{Column: "col", Reason: "a number for a text column"})
+		})
+	})
+
+	Convey("Given coercion is off", t, func() {
+		opts := &sqlOptions{InvalidValuePolicy: invalidValueError, Coercion: coercionOff}
+
+		Convey("Then values should be sent as they are", func() {
+			v, err := formatValue(nil, opts, "col", "INT(10)", "forty two")
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, "forty two")
+		})
+	})
+
+	Convey("Given a data point with several invalid values", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "InStock:bool", "Name:string"},
+			},
+			Data: map[string]interface{}{"ID": "x", "InStock": "maybe", "Name": "First"},
+		}
+		opts := &sqlOptions{InvalidValuePolicy: invalidValueDeadLetter}
+
+		Convey("Then each invalid column should be reported", func() {
+			_, _, err := createUpsertSQL(mariaDB, opts, dp, shapeutils.NewKnownShape(dp))
+			So(isValueError(err), ShouldBeTrue)
+			So(err, ShouldHaveLength, 2)
+			So(err.Error(), ShouldEqual, `invalid value for column "ID": a string which isn't a number for an INT column; `+
+				`invalid value for column "InStock": a string which isn't a boolean for a BIT column`)
+		})
+	})
+
+	Convey("An unknown coercion setting should be rejected", t, func() {
+		_, err := newSQLOptions(&settings{ValueCoercion: "guess"})
+		So(err, ShouldNotBeNil)
+	})
+}
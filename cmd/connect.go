@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultConnectRetries = 3
+	connectBackoffBase    = 500 * time.Millisecond
+	connectBackoffMax     = 30 * time.Second
+)
+
+// MySQL server error numbers relevant to connecting.
+const (
+	errDBAccessDenied    = 1044
+	errAccessDenied      = 1045
+	errUnknownDatabase   = 1049
+	errHostNotPrivileged = 1130
+)
+
+// connectErrorKind distinguishes the reasons a connection can fail.
+type connectErrorKind string
+
+const (
+	connectErrorAuth        connectErrorKind = "authentication failed"
+	connectErrorUnknownDB   connectErrorKind = "unknown database"
+	connectErrorUnreachable connectErrorKind = "host unreachable"
+	connectErrorOther       connectErrorKind = "connection failed"
+)
+
+// connectError is returned when the database can't be reached.
+type connectError struct {
+	Kind connectErrorKind
+	Addr string
+	Err  error
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Kind, e.Addr, e.Err)
+}
+
+// retryable reports whether trying again might succeed.
+func (e *connectError) retryable() bool {
+	return e.Kind == connectErrorUnreachable || e.Kind == connectErrorOther
+}
+
+func classifyConnectError(addr string, err error) *connectError {
+	ce := &connectError{Kind: connectErrorOther, Addr: addr, Err: err}
+
+	if myErr, ok := err.(*mysql.MySQLError); ok {
+		switch myErr.Number {
+		case errAccessDenied, errDBAccessDenied, errHostNotPrivileged:
+			ce.Kind = connectErrorAuth
+		case errUnknownDatabase:
+			ce.Kind = connectErrorUnknownDB
+		}
+		return ce
+	}
+
+	if _, ok := err.(net.Error); ok {
+		ce.Kind = connectErrorUnreachable
+		return ce
+	}
+
+	switch err {
+	case context.DeadlineExceeded, driver.ErrBadConn, mysql.ErrInvalidConn:
+		ce.Kind = connectErrorUnreachable
+	}
+
+	return ce
+}
+
+// connection is an open, verified connection pool.
+type connection struct {
+	db            *sql.DB
+	addr          string
+	database      string
+	version       string
+	tlsConfigName string
+}
+
+// openConnection opens a connection pool using the settings,
+// and waits until the server can be reached.
+func openConnection(s *settings) (*connection, error) {
+	cfg, err := s.config()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &connection{
+		addr:     cfg.Addr,
+		database: cfg.DBName,
+	}
+
+	conn.tlsConfigName, err = s.registerTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		conn.close()
+		return nil, fmt.Errorf("couldn't open SQL connection: %s", err)
+	}
+
+	conn.db = sql.OpenDB(&sessionConnector{
+		Connector:  connector,
+		statements: s.sessionStatements(),
+	})
+
+	configurePool(conn.db, s)
+
+	err = pingWithRetry(conn.db, conn.addr, s)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+
+	err = conn.db.QueryRow("SELECT VERSION()").Scan(&conn.version)
+	if err != nil || len(conn.version) == 0 {
+		conn.close()
+		return nil, fmt.Errorf("couldn't get data from database server: %v", err)
+	}
+
+	return conn, nil
+}
+
+// close closes the pool and releases the TLS configuration.
+func (c *connection) close() error {
+	var err error
+	if c.db != nil {
+		err = c.db.Close()
+	}
+	if c.tlsConfigName != "" {
+		mysql.DeregisterTLSConfig(c.tlsConfigName)
+	}
+	return err
+}
+
+// configurePool applies the pool settings to db.
+func configurePool(db *sql.DB, s *settings) {
+	if s.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(s.MaxOpenConns)
+	}
+	if s.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(s.MaxIdleConns)
+	}
+	if s.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(s.ConnMaxLifetime)
+	}
+}
+
+// pingWithRetry pings the database, backing off exponentially between attempts.
+// Errors that won't go away by themselves, like bad credentials, are returned immediately.
+func pingWithRetry(db *sql.DB, addr string, s *settings) error {
+	timeout := s.ConnectTimeout
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
+	retries := s.ConnectRetries
+
+	var ce *connectError
+	delay := connectBackoffBase
+
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := db.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		ce = classifyConnectError(addr, err)
+		if !ce.retryable() || attempt >= retries {
+			return ce
+		}
+
+		logrus.WithError(err).WithField("attempt", attempt+1).Warnf("Couldn't connect, retrying in %s", delay)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > connectBackoffMax {
+			delay = connectBackoffMax
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassifyConnectError(t *testing.T) {
+
+	Convey("Should classify driver errors", t, func() {
+		classify := func(err error) connectErrorKind {
+			return classifyConnectError("localhost:3306", err).Kind
+		}
+
+		So(classify(&mysql.MySQLError{Number: 1045, Message: "Access denied"}), ShouldEqual, connectErrorAuth)
+		So(classify(&mysql.MySQLError{Number: 1049, Message: "Unknown database"}), ShouldEqual, connectErrorUnknownDB)
+		So(classify(context.DeadlineExceeded), ShouldEqual, connectErrorUnreachable)
+		So(classify(errors.New("something else")), ShouldEqual, connectErrorOther)
+	})
+
+	Convey("Only unreachable hosts should be retried", t, func() {
+		So((&connectError{Kind: connectErrorUnreachable}).retryable(), ShouldBeTrue)
+		So((&connectError{Kind: connectErrorAuth}).retryable(), ShouldBeFalse)
+		So((&connectError{Kind: connectErrorUnknownDB}).retryable(), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date column types which can be chosen for date properties.
+const (
+	sqlTypeDateTime      = "DATETIME"
+	sqlTypeDateTimeMicro = "DATETIME(6)"
+	sqlTypeDate          = "DATE"
+	sqlTypeTime          = "TIME"
+)
+
+// Policies for values which can't be converted to their column's type.
+const (
+	invalidValueNull       = "null"
+	invalidValueDeadLetter = "deadletter"
+	invalidValueError      = "error"
+)
+
+// Units for dates sent as numbers.
+const (
+	epochAuto         = "auto"
+	epochSeconds      = "s"
+	epochMilliseconds = "ms"
+	epochMicroseconds = "us"
+)
+
+// defaultDateLayouts are tried after any configured layouts.
+var defaultDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+	"15:04:05.999999999",
+	"20060102",
+	"2006",
+}
+
+// epochString matches strings which are plausibly epoch times: 10 digits of
+// seconds or 13 of milliseconds. Other numbers in strings, like "2019", aren't
+// read as epoch times.
+var epochString = regexp.MustCompile(`^-?([0-9]{10}|[0-9]{13})(\.[0-9]+)?$`)
+
+// dateOptions control how date values are parsed and stored.
+type dateOptions struct {
+	Layouts    []string
+	Location   *time.Location
+	EpochUnit  string
+	ColumnType string
+	Columns    map[string]string // Column types by property name
+}
+
+func newDateOptions(s *settings) (dateOptions, error) {
+	o := dateOptions{
+		Layouts:    s.DateLayouts,
+		Location:   time.UTC,
+		EpochUnit:  strings.ToLower(s.DateEpochUnit),
+		ColumnType: strings.ToUpper(s.DateColumnType),
+		Columns:    map[string]string{},
+	}
+
+	if s.DateTimeZone != "" {
+		loc, err := time.LoadLocation(s.DateTimeZone)
+		if err != nil {
+			return o, settingsError{"dateTimeZone", err.Error()}
+		}
+		o.Location = loc
+	}
+
+	switch o.EpochUnit {
+	case "":
+		o.EpochUnit = epochAuto
+	case epochAuto, epochSeconds, epochMilliseconds, epochMicroseconds:
+	default:
+		return o, settingsError{"dateEpochUnit", fmt.Sprintf("%q is not one of auto, s, ms or us", s.DateEpochUnit)}
+	}
+
+	if o.ColumnType == "" {
+		o.ColumnType = sqlTypeDateTime
+	}
+	if !isDateColumnType(o.ColumnType) {
+		return o, settingsError{"dateColumnType", fmt.Sprintf("%q is not one of DATETIME, DATETIME(6), DATE or TIME", s.DateColumnType)}
+	}
+
+	for property, t := range s.DateColumns {
+		t = strings.ToUpper(t)
+		if !isDateColumnType(t) {
+			return o, settingsError{"dateColumns", fmt.Sprintf("%q for %s is not one of DATETIME, DATETIME(6), DATE or TIME", t, property)}
+		}
+		o.Columns[property] = t
+	}
+
+	return o, nil
+}
+
+func isDateColumnType(t string) bool {
+	switch t {
+	case sqlTypeDateTime, sqlTypeDateTimeMicro, sqlTypeDate, sqlTypeTime:
+		return true
+	}
+	return false
+}
+
+// columnType returns the column type for a date property.
+func (o dateOptions) columnType(property string) string {
+	if t, ok := o.Columns[property]; ok {
+		return t
+	}
+	if o.ColumnType == "" {
+		return sqlTypeDateTime
+	}
+	return o.ColumnType
+}
+
+// parse converts value to a time. Strings are parsed with the configured layouts
+// and then the default layouts; numbers, and strings of epoch length, are treated
+// as Unix epoch times.
+func (o dateOptions) parse(value interface{}) (time.Time, bool) {
+	loc := o.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		v = strings.TrimSpace(v)
+		for _, layout := range o.Layouts {
+			if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+				return t, true
+			}
+		}
+		for _, layout := range defaultDateLayouts {
+			if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+				return t, true
+			}
+		}
+		if !epochString.MatchString(v) {
+			break
+		}
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return o.fromEpoch(n), true
+		}
+	case json.Number:
+		if n, err := v.Float64(); err == nil {
+			return o.fromEpoch(n), true
+		}
+	case float64:
+		return o.fromEpoch(v), true
+	case float32:
+		return o.fromEpoch(float64(v)), true
+	case int:
+		return o.fromEpoch(float64(v)), true
+	case int64:
+		return o.fromEpoch(float64(v)), true
+	}
+
+	return time.Time{}, false
+}
+
+func (o dateOptions) fromEpoch(n float64) time.Time {
+	unit := o.EpochUnit
+	if unit == epochAuto || unit == "" {
+		// 1e11 seconds is in the year 5138, 1e11 milliseconds is in 1973.
+		unit = epochSeconds
+		if math.Abs(n) >= 1e11 {
+			unit = epochMilliseconds
+		}
+	}
+
+	var nanos float64
+	switch unit {
+	case epochMilliseconds:
+		nanos = n * float64(time.Millisecond)
+	case epochMicroseconds:
+		nanos = n * float64(time.Microsecond)
+	default:
+		nanos = n * float64(time.Second)
+	}
+
+	return time.Unix(0, int64(nanos)).UTC()
+}
+
+// format renders t for a date column, in the target time zone.
+func (o dateOptions) format(sqlType string, t time.Time) string {
+	if o.Location != nil {
+		t = t.In(o.Location)
+	} else {
+		t = t.UTC()
+	}
+
+	switch sqlType {
+	case sqlTypeDate:
+		return t.Format("2006-01-02")
+	case sqlTypeTime:
+		return t.Format("15:04:05")
+	case sqlTypeDateTimeMicro:
+		return t.Format("2006-01-02 15:04:05.000000")
+	}
+	return t.Format(MySQLTimeFormat)
+}
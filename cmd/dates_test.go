@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDateOptions(t *testing.T) {
+
+	Convey("Given the default date options", t, func() {
+		opts := &sqlOptions{}
+
+		format := func(sqlType string, value interface{}) interface{} {
+			v, err := formatValue(nil, opts, "col", sqlType, value)
+			So(err, ShouldBeNil)
+			return v
+		}
+
+		Convey("Then common formats should be parsed", func() {
+			So(format("DATETIME", "2017-10-11T12:13:14Z"), ShouldEqual, "2017-10-11 12:13:14")
+			So(format("DATETIME", "2017-10-11T12:13:14.123456+02:00"), ShouldEqual, "2017-10-11 10:13:14")
+			So(format("DATETIME", "2017-10-11"), ShouldEqual, "2017-10-11 00:00:00")
+			So(format("DATETIME", "2017-10-11 12:13:14"), ShouldEqual, "2017-10-11 12:13:14")
+		})
+
+		Convey("Then epoch numbers should be parsed", func() {
+			So(format("DATETIME", 1507723994.0), ShouldEqual, "2017-10-11 12:13:14")
+			So(format("DATETIME", 1507723994123.0), ShouldEqual, "2017-10-11 12:13:14")
+			So(format("DATETIME", "1507723994123"), ShouldEqual, "2017-10-11 12:13:14")
+			So(format("DATETIME", "1507723994"), ShouldEqual, "2017-10-11 12:13:14")
+		})
+
+		Convey("Then numeric strings of other lengths should be read as dates", func() {
+			So(format("DATETIME", "20191018"), ShouldEqual, "2019-10-18 00:00:00")
+			So(format("DATE", "2019"), ShouldEqual, "2019-01-01")
+
+			_, err := formatValue(nil, opts, "col", "DATETIME", "123456")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then the column type should control the precision", func() {
+			So(format("DATETIME(6)", "2017-10-11T12:13:14.123456Z"), ShouldEqual, "2017-10-11 12:13:14.123456")
+			So(format("DATE", "2017-10-11T12:13:14Z"), ShouldEqual, "2017-10-11")
+			So(format("TIME", "2017-10-11T12:13:14Z"), ShouldEqual, "12:13:14")
+		})
+
+		Convey("Then missing values should stay NULL", func() {
+			So(format("DATETIME", nil), ShouldBeNil)
+		})
+
+		Convey("When a value can't be parsed", func() {
+			Convey("Then it should fail by default, naming the column", nil)
+			_, err := formatValue(nil, opts, "col", "DATETIME", "last tuesday")
+			So(err, ShouldResemble, &valueError{Column: "col", Reason: "not a recognized date or time for a DATETIME column"})
+
+			Convey("Then the null policy should store NULL", nil)
+			opts.InvalidValuePolicy = invalidValueNull
+			So(format("DATETIME", "last tuesday"), ShouldBeNil)
+		})
+	})
+
+	Convey("Given date settings", t, func() {
+		s := &settings{
+			DateLayouts:    []string{"02/01/2006 15:04"},
+			DateTimeZone:   "America/New_York",
+			DateEpochUnit:  "s",
+			DateColumnType: "datetime(6)",
+			DateColumns:    map[string]string{"birthday": "date"},
+		}
+
+		opts, err := newSQLOptions(s)
+		So(err, ShouldBeNil)
+
+		Convey("Then custom layouts should be read in the target time zone", func() {
+			v, err := formatValue(nil, opts, "col", "DATETIME", "11/10/2017 08:13")
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, "2017-10-11 08:13:00")
+		})
+
+		Convey("Then values should be converted to the target time zone", func() {
+			v, _ := formatValue(nil, opts, "col", "DATETIME", "2017-10-11T12:13:14Z")
+			So(v, ShouldEqual, "2017-10-11 08:13:14")
+		})
+
+		Convey("Then column types should follow the settings", func() {
+			So(opts.sqlType(mariaDB, "birthday", "date", false), ShouldEqual, "DATE")
+			So(opts.sqlType(mariaDB, "updated", "date", false), ShouldEqual, "DATETIME(6)")
+		})
+
+		Convey("When the time zone is unknown", func() {
+			s.DateTimeZone = "Mars/Olympus"
+			_, err := newSQLOptions(s)
+			So(err.(settingsError).Field, ShouldEqual, "dateTimeZone")
+		})
+	})
+
+	Convey("Given a time value", t, func() {
+		opts := dateOptions{}
+		parsed, ok := opts.parse(time.Date(2017, 10, 11, 12, 13, 14, 0, time.UTC))
+		So(ok, ShouldBeTrue)
+		So(opts.format(sqlTypeDateTime, parsed), ShouldEqual, "2017-10-11 12:13:14")
+	})
+}
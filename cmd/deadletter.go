@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/naveego/api/types/pipeline"
+)
+
+// systemTablePrefix marks the tables the subscriber keeps for itself.
+// They are not reported as shapes.
+const systemTablePrefix = "naveego_"
+
+const createDeadLetterTableSQL = "CREATE TABLE IF NOT EXISTS `naveego_dead_letters` (\n" +
+	"\t`id` BIGINT NOT NULL AUTO_INCREMENT,\n" +
+	"\t`shape` VARCHAR(255) NOT NULL,\n" +
+	"\t`publisher` VARCHAR(1000) NULL,\n" +
+	"\t`reason` TEXT NOT NULL,\n" +
+	"\t`data_point` LONGTEXT NOT NULL,\n" +
+	"\t`created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,\n" +
+	"\tPRIMARY KEY (`id`)\n" +
+	")"
+
+const insertDeadLetterSQL = "INSERT INTO `naveego_dead_letters` (`shape`, `publisher`, `reason`, `data_point`) VALUES (?, ?, ?, ?)"
+
+func isSystemTable(name string) bool {
+	return strings.HasPrefix(name, systemTablePrefix)
+}
+
+// deadLetter stores a data point which couldn't be written, with the reason, in the dead letter table.
+func (h *mariaSubscriber) deadLetter(shape string, dp pipeline.DataPoint, reason error) error {
+	h.deadLetterMu.Lock()
+	if !h.deadLetterTableReady {
+		if _, err := h.db.Exec(createDeadLetterTableSQL); err != nil {
+			h.deadLetterMu.Unlock()
+			return err
+		}
+		h.deadLetterTableReady = true
+	}
+	h.deadLetterMu.Unlock()
+
+	data, err := json.Marshal(dp)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.Exec(insertDeadLetterSQL, shape, dp.Meta["publisher"], reason.Error(), string(data))
+	return err
+}
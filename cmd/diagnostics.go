@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requiredPrivileges are the privileges the subscriber needs on its database.
+var requiredPrivileges = []string{"SELECT", "INSERT", "UPDATE", "CREATE", "ALTER"}
+
+// minMaxAllowedPacket is the smallest max_allowed_packet we consider safe for batches of wide rows.
+const minMaxAllowedPacket = 4 * 1024 * 1024
+
+// checkResult is the outcome of a single diagnostic check. A check which didn't
+// pass but is only a warning doesn't fail the report.
+type checkResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Warning bool   `json:"warning,omitempty"`
+	Message string `json:"message"`
+}
+
+// diagnosticReport is the result of TestConnection.
+type diagnosticReport struct {
+	Success bool          `json:"success"`
+	Server  string        `json:"server,omitempty"`
+	Checks  []checkResult `json:"checks"`
+}
+
+func (r *diagnosticReport) add(name string, passed bool, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, checkResult{
+		Name:    name,
+		Passed:  passed,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// warn adds a check which only warns when it doesn't pass.
+func (r *diagnosticReport) warn(name string, passed bool, format string, args ...interface{}) {
+	r.add(name, passed, format, args...)
+	r.Checks[len(r.Checks)-1].Warning = !passed
+}
+
+func (r *diagnosticReport) skip(name string, message string) {
+	r.Checks = append(r.Checks, checkResult{Name: name, Passed: true, Skipped: true, Message: message})
+}
+
+func (r *diagnosticReport) finish() {
+	r.Success = true
+	for _, c := range r.Checks {
+		if !c.Passed && !c.Warning {
+			r.Success = false
+		}
+	}
+}
+
+// diagnose checks that conn can be used by the subscriber. It does not change anything
+// in the database, unless the settings opt in to a scratch table write test.
+func diagnose(conn *connection, s *settings) diagnosticReport {
+	version := parseServerVersion(conn.version)
+
+	report := diagnosticReport{Server: conn.version}
+	report.add("connect", true, "Connected to %s at %s", version, conn.addr)
+
+	checkTLS(&report, conn.db, s)
+	checkFeatures(&report, conn.db, newDialect(conn.version), s)
+	checkGrants(&report, conn.db, conn.database)
+
+	if s.TestWrites {
+		checkScratchWrite(&report, conn.db)
+	} else {
+		report.skip("scratch-write", "Set testWrites to create, insert into and drop a scratch table")
+	}
+
+	report.finish()
+	return report
+}
+
+func checkTLS(report *diagnosticReport, db *sql.DB, s *settings) {
+	tlsInfo, err := describeTLS(db)
+	if err == nil {
+		report.add("tls", true, "%s", tlsInfo)
+		return
+	}
+
+	requested := s.hasCustomTLS()
+	switch strings.ToLower(s.TLSMode) {
+	case "true", "skip-verify":
+		requested = true
+	}
+
+	report.add("tls", !requested, "%s", err)
+}
+
+// checkFeatures fails only for features the settings need, and warns about the rest.
+func checkFeatures(report *diagnosticReport, db *sql.DB, d dialect, s *settings) {
+	features := d.Features()
+
+	if features.AddColumnIfNotExists {
+		report.add("dialect", true, "Using the %s dialect with ADD COLUMN IF NOT EXISTS", d.Name())
+	} else {
+		report.add("dialect", true, "Using the %s dialect, existing columns are read from INFORMATION_SCHEMA", d.Name())
+	}
+
+	report.warn("json", features.JSON, "JSON functions require MariaDB 10.2.7 or MySQL 5.7.8 or later, the appendarray merge rule needs them")
+
+	opts, err := newSQLOptions(s)
+	if err == nil {
+		err = opts.checkFeatures(d)
+	}
+	if err != nil {
+		report.add("settings", false, "%s", err)
+	} else {
+		report.add("settings", true, "The server supports the configured settings")
+	}
+
+	var packet int64
+	err = db.QueryRow("SELECT @@max_allowed_packet").Scan(&packet)
+	if err != nil {
+		report.warn("max-allowed-packet", false, "Couldn't read max_allowed_packet: %s", err)
+		return
+	}
+	report.warn("max-allowed-packet", packet >= minMaxAllowedPacket,
+		"max_allowed_packet is %d bytes, at least %d is recommended", packet, minMaxAllowedPacket)
+}
+
+var grantPattern = regexp.MustCompile(`^GRANT (.+?) ON (\S+) TO `)
+
+// rolePattern matches the lines of SHOW GRANTS which grant roles, like
+// GRANT `writer` TO `bucket`@`%` on MariaDB or GRANT `writer`@`%` TO `bucket`@`%` on MySQL.
+var rolePattern = regexp.MustCompile("^GRANT ((?:`[^`]+`(?:@`[^`]*`)?,?\\s*)+) TO ")
+
+var roleNamePattern = regexp.MustCompile("`[^`]+`(?:@`[^`]*`)?")
+
+// defaultRolePattern matches the default role MariaDB lists after the grants.
+var defaultRolePattern = regexp.MustCompile("^SET DEFAULT ROLE (`[^`]+`) FOR ")
+
+func checkGrants(report *diagnosticReport, db *sql.DB, database string) {
+	grants, err := showGrants(db, "SHOW GRANTS")
+	if err != nil {
+		report.add("grants", false, "Couldn't read grants: %s", err)
+		return
+	}
+
+	// SHOW GRANTS only lists the roles a user has, not what they grant,
+	// so the roles' grants are read as well, including the roles they have.
+	var unread []string
+	seen := map[string]bool{}
+	roles := activeRoles(grants)
+	for len(roles) > 0 {
+		role := roles[0]
+		roles = roles[1:]
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+
+		roleGrants, err := showGrants(db, "SHOW GRANTS FOR "+role)
+		if err != nil {
+			unread = append(unread, role)
+			continue
+		}
+		grants = append(grants, roleGrants...)
+		roles = append(roles, grantedRoles(roleGrants)...)
+	}
+
+	missing := missingPrivileges(grants, database)
+	if len(missing) > 0 && len(unread) > 0 {
+		report.warn("grants", false, "Missing %s on database %q, unless the roles %s grant them, which couldn't be read",
+			strings.Join(missing, ", "), database, strings.Join(unread, ", "))
+		return
+	}
+	if len(missing) > 0 {
+		report.add("grants", false, "Missing %s on database %q", strings.Join(missing, ", "), database)
+		return
+	}
+	report.add("grants", true, "Has %s on database %q", strings.Join(requiredPrivileges, ", "), database)
+}
+
+func showGrants(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []string
+	for rows.Next() {
+		var grant string
+		if err = rows.Scan(&grant); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// activeRoles returns the roles from grants which are set when the plugin connects.
+// MariaDB only sets the default role, MySQL doesn't list its default roles, so
+// every role granted is assumed to be set.
+func activeRoles(grants []string) []string {
+	for _, grant := range grants {
+		if m := defaultRolePattern.FindStringSubmatch(grant); m != nil {
+			return []string{m[1]}
+		}
+	}
+	return grantedRoles(grants)
+}
+
+// grantedRoles returns the roles granted by grants, quoted for SHOW GRANTS FOR.
+func grantedRoles(grants []string) []string {
+	var roles []string
+	for _, grant := range grants {
+		if m := rolePattern.FindStringSubmatch(grant); m != nil {
+			roles = append(roles, roleNamePattern.FindAllString(m[1], -1)...)
+		}
+	}
+	return roles
+}
+
+// missingPrivileges returns the required privileges not given on database by grants,
+// which are lines returned by SHOW GRANTS.
+func missingPrivileges(grants []string, database string) []string {
+	held := map[string]bool{}
+
+	for _, grant := range grants {
+		m := grantPattern.FindStringSubmatch(grant)
+		if m == nil || !grantScopeMatches(m[2], database) {
+			continue
+		}
+		for _, p := range strings.Split(m[1], ",") {
+			p = strings.ToUpper(strings.TrimSpace(p))
+			if strings.Contains(p, "(") {
+				// Column level privileges aren't enough to manage tables.
+				continue
+			}
+			held[p] = true
+		}
+	}
+
+	var missing []string
+	for _, p := range requiredPrivileges {
+		if !held[p] && !held["ALL"] && !held["ALL PRIVILEGES"] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// grantScopeMatches reports whether a grant scope like *.*, `db`.* or `d\_b%`.*
+// covers every table in database.
+func grantScopeMatches(scope, database string) bool {
+	if scope == "*.*" {
+		return true
+	}
+	if !strings.HasSuffix(scope, ".*") {
+		// Table level grants don't allow creating new tables.
+		return false
+	}
+
+	pattern := strings.Trim(strings.TrimSuffix(scope, ".*"), "`")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case c == '%':
+			expr.WriteString(".*")
+		case c == '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+
+	matched, _ := regexp.MatchString(expr.String(), database)
+	return matched
+}
+
+func checkScratchWrite(report *diagnosticReport, db *sql.DB) {
+	table := fmt.Sprintf("naveego_scratch_%d", time.Now().UnixNano())
+
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE `%s` (`id` INT NOT NULL PRIMARY KEY, `value` VARCHAR(50) NULL)", table))
+	if err != nil {
+		report.add("scratch-write", false, "Couldn't create scratch table: %s", err)
+		return
+	}
+
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO `%s` (`id`, `value`) VALUES (1, 'test') ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)", table))
+	_, dropErr := db.Exec(fmt.Sprintf("DROP TABLE `%s`", table))
+
+	switch {
+	case err != nil:
+		report.add("scratch-write", false, "Couldn't insert into scratch table: %s", err)
+	case dropErr != nil:
+		report.add("scratch-write", false, "Couldn't drop scratch table %s: %s", table, dropErr)
+	default:
+		report.add("scratch-write", true, "Created, inserted into and dropped a scratch table")
+	}
+}
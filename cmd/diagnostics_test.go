@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMissingPrivileges(t *testing.T) {
+
+	Convey("Given grants from SHOW GRANTS", t, func() {
+
+		Convey("When the user has all privileges", func() {
+			grants := []string{"GRANT ALL PRIVILEGES ON *.* TO 'root'@'localhost' WITH GRANT OPTION"}
+			So(missingPrivileges(grants, "naveego"), ShouldBeEmpty)
+		})
+
+		Convey("When the user has privileges on the database", func() {
+			grants := []string{
+				"GRANT USAGE ON *.* TO 'bucket'@'%' IDENTIFIED BY PASSWORD '*ABC'",
+				"GRANT SELECT, INSERT, UPDATE, CREATE, ALTER ON `naveego`.* TO 'bucket'@'%'",
+			}
+			So(missingPrivileges(grants, "naveego"), ShouldBeEmpty)
+			Convey("Then other databases should not be covered", nil)
+			So(missingPrivileges(grants, "other"), ShouldResemble, []string{"ALTER", "CREATE", "INSERT", "SELECT", "UPDATE"})
+		})
+
+		Convey("When the grant uses a wildcard", func() {
+			grants := []string{"GRANT SELECT, INSERT, UPDATE, CREATE, ALTER ON `nav\\_%`.* TO 'bucket'@'%'"}
+			So(missingPrivileges(grants, "nav_prod"), ShouldBeEmpty)
+			So(missingPrivileges(grants, "navXprod"), ShouldNotBeEmpty)
+		})
+
+		Convey("When privileges are missing", func() {
+			grants := []string{
+				"GRANT SELECT, INSERT ON `naveego`.* TO 'bucket'@'%'",
+				"GRANT ALTER ON `naveego`.`products` TO 'bucket'@'%'",
+			}
+			So(missingPrivileges(grants, "naveego"), ShouldResemble, []string{"ALTER", "CREATE", "UPDATE"})
+		})
+	})
+}
+
+func TestCheckGrants(t *testing.T) {
+
+	Convey("Given a user whose privileges are granted through a role", t, func() {
+		db, fake := newFakeDB()
+		defer db.Close()
+		grants := map[string][]string{
+			"SHOW GRANTS": {
+				"GRANT USAGE ON *.* TO `bucket`@`%`",
+				"GRANT `reader`, `writer` TO `bucket`@`%`",
+				"SET DEFAULT ROLE `writer` FOR `bucket`@`%`",
+			},
+			"SHOW GRANTS FOR `writer`": {
+				"GRANT `creator` TO `writer`",
+				"GRANT SELECT, INSERT, UPDATE ON `naveego`.* TO `writer`",
+			},
+			"SHOW GRANTS FOR `creator`": {
+				"GRANT CREATE, ALTER ON `naveego`.* TO `creator`",
+			},
+		}
+		fake.rows = func(query string) ([]string, [][]driver.Value) {
+			var values [][]driver.Value
+			for _, grant := range grants[query] {
+				values = append(values, []driver.Value{grant})
+			}
+			return []string{"Grants"}, values
+		}
+
+		Convey("When the grants are checked", func() {
+			report := diagnosticReport{}
+			checkGrants(&report, db, "naveego")
+			report.finish()
+
+			Convey("Then the privileges of the default role and the roles it has should count", nil)
+			So(report.Success, ShouldBeTrue)
+			So(report.Checks[0].Passed, ShouldBeTrue)
+
+			Convey("Then only the default role should be read", nil)
+			for _, e := range fake.executed() {
+				So(e.query, ShouldNotEqual, "SHOW GRANTS FOR `reader`")
+			}
+		})
+
+		Convey("When the role's grants can't be read", func() {
+			fake.fail = func(query string, args []driver.Value) error {
+				if query == "SHOW GRANTS FOR `writer`" {
+					return errors.New("access denied")
+				}
+				return nil
+			}
+			report := diagnosticReport{}
+			checkGrants(&report, db, "naveego")
+			report.finish()
+
+			Convey("Then the missing privileges should only be warned about", nil)
+			So(report.Success, ShouldBeTrue)
+			So(report.Checks[0].Warning, ShouldBeTrue)
+			So(report.Checks[0].Message, ShouldContainSubstring, "`writer`")
+		})
+	})
+
+	Convey("Given roles granted on MySQL", t, func() {
+		grants := []string{"GRANT `reader`@`%`,`writer`@`%` TO `bucket`@`%`"}
+
+		Convey("Then every role should be taken as set", func() {
+			So(activeRoles(grants), ShouldResemble, []string{"`reader`@`%`", "`writer`@`%`"})
+		})
+	})
+}
+
+func TestCheckFeatures(t *testing.T) {
+
+	Convey("Given a server without JSON functions and a small max_allowed_packet", t, func() {
+		db, fake := newFakeDB()
+		defer db.Close()
+		fake.rows = func(string) ([]string, [][]driver.Value) {
+			return []string{"@@max_allowed_packet"}, [][]driver.Value{{int64(1024 * 1024)}}
+		}
+		d := newDialect("10.1.40-MariaDB")
+
+		check := func(report diagnosticReport, name string) checkResult {
+			for _, c := range report.Checks {
+				if c.Name == name {
+					return c
+				}
+			}
+			return checkResult{}
+		}
+
+		Convey("When the settings don't need them", func() {
+			report := diagnosticReport{}
+			checkFeatures(&report, db, d, &settings{})
+			report.finish()
+
+			Convey("Then they should only be warned about", nil)
+			So(report.Success, ShouldBeTrue)
+			So(check(report, "json").Warning, ShouldBeTrue)
+			So(check(report, "max-allowed-packet").Warning, ShouldBeTrue)
+		})
+
+		Convey("When a merge rule needs JSON functions", func() {
+			report := diagnosticReport{}
+			checkFeatures(&report, db, d, &settings{MergeRules: map[string]string{"Tags": mergeAppendArray}})
+			report.finish()
+
+			Convey("Then the report should fail", nil)
+			So(report.Success, ShouldBeFalse)
+			So(check(report, "settings").Passed, ShouldBeFalse)
+		})
+	})
+}
+
+func TestParseServerVersion(t *testing.T) {
+
+	Convey("Should parse version strings", t, func() {
+		v := parseServerVersion("5.5.5-10.3.8-MariaDB-1:10.3.8+maria~jessie")
+		So(v.MariaDB, ShouldBeTrue)
+		So(v.atLeast(10, 3, 8), ShouldBeTrue)
+		So(v.atLeast(10, 4, 0), ShouldBeFalse)
+
+		v = parseServerVersion("8.0.21")
+		So(v.MariaDB, ShouldBeFalse)
+		So(v.atLeast(8, 0, 20), ShouldBeTrue)
+		So(v.String(), ShouldEqual, "MySQL 8.0.21")
+	})
+}
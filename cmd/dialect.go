@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// dialect renders SQL for a particular kind of server.
+type dialect interface {
+	// Name identifies the dialect in logs and diagnostics.
+	Name() string
+
+	// Features reports what the server supports.
+	Features() dialectFeatures
+
+	// SQLType maps a shape property type to a column type.
+	SQLType(propertyType string, isKey bool) string
+
+	// CreateTableSQL renders the statement creating the table for a new shape.
+	CreateTableSQL(model sqlTableModel) (string, error)
+
+	// AlterTableSQL renders the statement adding the model's columns to an existing table.
+	// existingColumns are the columns already in the table, for dialects without
+	// AddColumnIfNotExists. It returns an empty string if there is nothing to do.
+	AlterTableSQL(model sqlTableModel, existingColumns map[string]bool) (string, error)
+
+	// UpsertSQL renders the INSERT ... ON DUPLICATE KEY UPDATE statement for the model.
+	UpsertSQL(model sqlTableModel) (string, error)
+}
+
+// dialectFeatures are the capabilities of a server which change the SQL we generate.
+type dialectFeatures struct {
+	AddColumnIfNotExists bool
+	JSON                 bool
+	JSONMergePreserve    bool
+	Sequences            bool
+	UpsertRowAlias       bool
+}
+
+// newDialect chooses the dialect for a VERSION() string.
+func newDialect(version string) dialect {
+	v := parseServerVersion(version)
+	if v.MariaDB {
+		return mariaDialect{version: v}
+	}
+	return mysqlDialect{version: v}
+}
+
+// mariaDialect is used for MariaDB servers.
+type mariaDialect struct {
+	version serverVersion
+}
+
+func (d mariaDialect) Name() string { return "mariadb" }
+
+func (d mariaDialect) Features() dialectFeatures {
+	return dialectFeatures{
+		AddColumnIfNotExists: d.version.atLeast(10, 0, 2),
+		JSON:                 d.version.atLeast(10, 2, 7),
+		JSONMergePreserve:    d.version.atLeast(10, 2, 25),
+		Sequences:            d.version.atLeast(10, 3, 0),
+	}
+}
+
+func (d mariaDialect) SQLType(propertyType string, isKey bool) string {
+	return convertToSQLType(propertyType, isKey)
+}
+
+func (d mariaDialect) CreateTableSQL(model sqlTableModel) (string, error) {
+	return renderTemplate(createTemplate, model)
+}
+
+func (d mariaDialect) AlterTableSQL(model sqlTableModel, existingColumns map[string]bool) (string, error) {
+	if !d.Features().AddColumnIfNotExists {
+		return mysqlDialect{version: d.version}.AlterTableSQL(model, existingColumns)
+	}
+	return renderTemplate(alterTemplate, model)
+}
+
+func (d mariaDialect) UpsertSQL(model sqlTableModel) (string, error) {
+	model.Updates = upsertAssignments(model, valuesFunction)
+	return renderTemplate(upsertTemplate, model)
+}
+
+// mysqlDialect is used for MySQL and Aurora MySQL servers.
+type mysqlDialect struct {
+	version serverVersion
+}
+
+func (d mysqlDialect) Name() string { return "mysql" }
+
+func (d mysqlDialect) Features() dialectFeatures {
+	return dialectFeatures{
+		JSON:              d.version.atLeast(5, 7, 8),
+		JSONMergePreserve: d.version.atLeast(5, 7, 22),
+		UpsertRowAlias:    d.version.atLeast(8, 0, 20),
+	}
+}
+
+func (d mysqlDialect) SQLType(propertyType string, isKey bool) string {
+	return convertToSQLType(propertyType, isKey)
+}
+
+func (d mysqlDialect) CreateTableSQL(model sqlTableModel) (string, error) {
+	return renderTemplate(createTemplate, model)
+}
+
+func (d mysqlDialect) AlterTableSQL(model sqlTableModel, existingColumns map[string]bool) (string, error) {
+	var columns sqlColumns
+	for _, c := range model.Columns {
+		if !existingColumns[c.Name] {
+			columns = append(columns, c)
+		}
+	}
+	model.Columns = columns
+
+	if len(model.Columns) == 0 && len(model.Keys) == 0 {
+		return "", nil
+	}
+
+	return renderTemplate(mysqlAlterTemplate, model)
+}
+
+func (d mysqlDialect) UpsertSQL(model sqlTableModel) (string, error) {
+	if d.Features().UpsertRowAlias {
+		model.Updates = upsertAssignments(model, rowAlias)
+		return renderTemplate(mysqlAliasUpsertTemplate, model)
+	}
+	model.Updates = upsertAssignments(model, valuesFunction)
+	return renderTemplate(upsertTemplate, model)
+}
+
+// existingColumns returns the names of the columns in table.
+func existingColumns(db *sql.DB, table string) (map[string]bool, error) {
+	types, err := columnTypes(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]bool, len(types))
+	for name := range types {
+		columns[name] = true
+	}
+	return columns, nil
+}
+
+// columnTypes returns the declared type of each column in table, in upper case,
+// e.g. "BIGINT(20) UNSIGNED".
+func columnTypes(db *sql.DB, table string) (map[string]string, error) {
+	rows, err := db.Query(`SELECT COLUMN_NAME, COLUMN_TYPE FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := map[string]string{}
+	for rows.Next() {
+		var name, columnType string
+		if err = rows.Scan(&name, &columnType); err != nil {
+			return nil, err
+		}
+		types[name] = strings.ToUpper(columnType)
+	}
+
+	return types, rows.Err()
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// fakeDriver is a database/sql driver which records the statements executed on it.
+type fakeDriver struct {
+	mu    sync.Mutex
+	execs []fakeExec
+
+	// fail, if set, is called for every statement and can return an error for it.
+	fail func(query string, args []driver.Value) error
+
+	// rows, if set, returns the result of a query. Queries return no rows otherwise.
+	rows func(query string) (columns []string, values [][]driver.Value)
+}
+
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+var fakeDriverCount int64
+
+// newFakeDB returns a *sql.DB backed by a new fakeDriver.
+func newFakeDB() (*sql.DB, *fakeDriver) {
+	d := &fakeDriver{}
+	name := fmt.Sprintf("fake-%d", atomic.AddInt64(&fakeDriverCount, 1))
+	sql.Register(name, d)
+	db, _ := sql.Open(name, "")
+	return db, d
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{driver: d}, nil
+}
+
+func (d *fakeDriver) executed() []fakeExec {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]fakeExec(nil), d.execs...)
+}
+
+func (d *fakeDriver) record(query string, args []driver.Value) error {
+	if d.fail != nil {
+		if err := d.fail(query, args); err != nil {
+			return err
+		}
+	}
+	d.mu.Lock()
+	d.execs = append(d.execs, fakeExec{query: query, args: args})
+	d.mu.Unlock()
+	return nil
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.conn.driver.record(s.query, args); err != nil {
+		return nil, err
+	}
+	return fakeResult{}, nil
+}
+
+// fakeResult reports one row affected, and an insert ID of 1.
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) { return 1, nil }
+func (fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.conn.driver.record(s.query, args); err != nil {
+		return nil, err
+	}
+	if s.conn.driver.rows != nil {
+		columns, values := s.conn.driver.rows(s.query)
+		return &fakeRows{columns: columns, values: values}, nil
+	}
+	return &fakeRows{columns: []string{"value"}}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
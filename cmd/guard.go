@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	"github.com/sirupsen/logrus"
+)
+
+const publishedAtColumn = "naveegoPublishedAt"
+
+// systemColumns are the columns the subscriber adds to every table, in the order they're written.
+var systemColumns = []string{"naveegoPublisher", publishedAtColumn, "naveegoShapeVersion"}
+
+// versionColumn returns the column the out-of-order guard compares for model,
+// or "" if the guard is off. Shapes without the configured version property
+// are guarded by naveegoPublishedAt.
+func (o *sqlOptions) versionColumn(model sqlTableModel) string {
+	if o.VersionColumn == "" || o.VersionColumn == publishedAtColumn {
+		return o.VersionColumn
+	}
+	for _, c := range model.Columns {
+		if c.Name == o.VersionColumn {
+			return c.Name
+		}
+	}
+	return publishedAtColumn
+}
+
+// upsertAssignments returns the ON DUPLICATE KEY UPDATE assignments for model.
+// incoming renders the value being inserted for a column, which depends on the dialect.
+// Each column's merge rule decides how the incoming value is combined with the stored one;
+// the system and version columns are always overwritten.
+//
+// When the model has a version column, every assignment only takes effect if the incoming
+// version is at least the stored one. A data point without a version can't be ordered, so
+// it's applied and the stored version is kept. The version column is assigned last, because
+// MySQL uses the already updated values in the assignments which follow.
+func upsertAssignments(model sqlTableModel, incoming func(column string) string) []sqlAssignment {
+	var columns []sqlColumnModel
+	for _, c := range model.NonKeyColumns {
+		if c.Name != model.Version {
+			columns = append(columns, c)
+		}
+	}
+	for _, c := range systemColumns {
+		if c != model.Version {
+			columns = append(columns, sqlColumnModel{Name: c})
+		}
+	}
+	if model.Version != "" {
+		columns = append(columns, sqlColumnModel{Name: model.Version})
+	}
+
+	var condition string
+	if model.Version != "" {
+		version := "`" + model.Version + "`"
+		condition = fmt.Sprintf("%[1]s IS NULL OR %[2]s IS NULL OR %[2]s >= %[1]s", version, incoming(model.Version))
+	}
+
+	assignments := make([]sqlAssignment, 0, len(columns))
+	for _, c := range columns {
+		value := mergeValue(c.Merge, c.Name, incoming(c.Name))
+		if c.Name == model.Version {
+			value = fmt.Sprintf("COALESCE(%s, `%s`)", incoming(c.Name), c.Name)
+		}
+		if condition != "" {
+			value = fmt.Sprintf("IF(%s, %s, `%s`)", condition, value, c.Name)
+		}
+		assignments = append(assignments, sqlAssignment{Column: c.Name, Value: value})
+	}
+
+	return assignments
+}
+
+func valuesFunction(column string) string { return "VALUES(`" + column + "`)" }
+
+func rowAlias(column string) string { return "new.`" + column + "`" }
+
+// staleCheck returns the query which tells whether the stored version of a data point's
+// record is newer than the data point. It's only run when the upsert changed nothing,
+// to tell a stale write from one which didn't change any values.
+// It returns nil if the guard is off or the shape has no keys.
+func staleCheck(d dialect, opts *sqlOptions, dp pipeline.DataPoint, knownShape *shapeutils.KnownShape) (*statement, error) {
+	model := upsertModel(d, opts, knownShape)
+	if model.Version == "" || len(model.Keys) == 0 {
+		return nil, nil
+	}
+
+	var (
+		conditions []string
+		params     []interface{}
+		version    interface{}
+		err        error
+	)
+
+	for _, c := range model.Columns {
+		if c.IsKey {
+			value, err := opts.columnValue(dp, c.Name, c.IsKey)
+			if err != nil {
+				return nil, err
+			}
+			value, err = formatValue(nil, opts, c.Name, c.SqlType, value)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, "`"+c.Name+"` = ?")
+			params = append(params, value)
+		}
+		if c.Name == model.Version {
+			if version, err = formatValue(nil, opts, c.Name, c.SqlType, dp.Data[c.Name]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if model.Version == publishedAtColumn {
+		if version, err = publishedAtValue(nil, opts, dp); err != nil {
+			return nil, err
+		}
+	}
+
+	conditions = append(conditions, "`"+model.Version+"` > ?")
+	params = append(params, version)
+
+	return &statement{
+		sql:    fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE %s", model.Name, strings.Join(conditions, " AND ")),
+		params: params,
+	}, nil
+}
+
+// rowQuerier is satisfied by *sql.DB and *sql.Conn.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// countStale adds a write to the stale count if the guard kept it from changing the record.
+func countStale(ctx context.Context, log *logrus.Entry, db rowQuerier, result sql.Result, check *statement, summary *runSummary) {
+	if check == nil || result == nil {
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 0 {
+		return
+	}
+
+	var stale int
+	if err := db.QueryRowContext(ctx, check.sql, check.params...).Scan(&stale); err != nil {
+		log.WithError(err).Warn("Couldn't check whether a write was stale")
+		return
+	}
+
+	if stale > 0 {
+		atomic.AddInt64(&summary.Stale, 1)
+		log.WithField("sql", check.sql).Debug("Skipped stale write")
+	}
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPingInterval = 15 * time.Second
+	pingTimeout         = 5 * time.Second
+)
+
+// healthState is a snapshot of the subscriber for the health checks.
+type healthState struct {
+	Initialized      bool
+	ShuttingDown     bool
+	DeadLettered     int64
+	DeadLetterBudget int64
+	LastWrite        time.Time
+}
+
+// healthTarget is the run the health checks look at. It's published by Init
+// and Dispose, so the checks never wait for the subscriber's lock.
+type healthTarget struct {
+	db               *sql.DB
+	summary          *runSummary
+	deadLetterBudget int64
+}
+
+// publishHealth shows the health checks the current run, if there is one.
+// h.mu must be held for writing.
+func (h *mariaSubscriber) publishHealth() {
+	target := &healthTarget{}
+	if h.db != nil && h.summary != nil {
+		target = &healthTarget{db: h.db, summary: h.summary, deadLetterBudget: h.settings.DeadLetterBudget}
+	}
+	h.health.Store(target)
+}
+
+// healthState returns the state of the subscriber, and its connection if it's initialized.
+func (h *mariaSubscriber) healthState() (healthState, pinger) {
+	if h.isClosing() {
+		return healthState{ShuttingDown: true}, nil
+	}
+
+	target, _ := h.health.Load().(*healthTarget)
+	if target == nil || target.db == nil {
+		return healthState{}, nil
+	}
+
+	return healthState{
+		Initialized:      true,
+		DeadLettered:     target.summary.deadLettered(),
+		DeadLetterBudget: target.deadLetterBudget,
+		LastWrite:        target.summary.lastWrite(),
+	}, target.db
+}
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// healthChecker reports whether the subscriber is alive and ready for data.
+type healthChecker struct {
+	state        func() (healthState, pinger)
+	pingInterval time.Duration
+	maxWriteAge  time.Duration
+
+	mu      sync.Mutex
+	pingErr error
+	pinged  bool
+}
+
+func newHealthChecker(sub *mariaSubscriber, pingInterval, maxWriteAge time.Duration) *healthChecker {
+	if pingInterval <= 0 {
+		pingInterval = defaultPingInterval
+	}
+	return &healthChecker{
+		state:        sub.healthState,
+		pingInterval: pingInterval,
+		maxWriteAge:  maxWriteAge,
+	}
+}
+
+// run pings the database every ping interval until stop is closed.
+func (c *healthChecker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		c.ping()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *healthChecker) ping() {
+	_, db := c.state()
+	if db == nil {
+		c.setPing(false, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	err := db.PingContext(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("Health check couldn't ping the database")
+	}
+	c.setPing(true, err)
+}
+
+func (c *healthChecker) setPing(pinged bool, err error) {
+	c.mu.Lock()
+	c.pinged, c.pingErr = pinged, err
+	c.mu.Unlock()
+}
+
+// liveness only reports that the process responds. An unreachable database or
+// a quiet publisher make the subscriber not ready, as a restart won't fix them.
+func (c *healthChecker) liveness() diagnosticReport {
+	var report diagnosticReport
+	report.add("responding", true, "The process is responding")
+	report.finish()
+	return report
+}
+
+// readiness fails when the subscriber shouldn't be sent data.
+func (c *healthChecker) readiness() diagnosticReport {
+	state, _ := c.state()
+
+	var report diagnosticReport
+	if state.ShuttingDown {
+		report.add("shutting-down", false, "The subscriber is shutting down")
+	}
+	if state.Initialized {
+		report.add("initialized", true, "Init has succeeded")
+	} else {
+		report.add("initialized", false, "Init hasn't been called or the subscriber was disposed")
+	}
+	c.addPing(&report, state)
+	c.addWriteAge(&report, state)
+
+	switch {
+	case !state.Initialized:
+		report.skip("dead-letter-budget", "Not initialized")
+	case state.DeadLetterBudget <= 0:
+		report.skip("dead-letter-budget", "No dead letter budget is set")
+	default:
+		report.add("dead-letter-budget", state.DeadLettered <= state.DeadLetterBudget,
+			"%d of %d dead letters used", state.DeadLettered, state.DeadLetterBudget)
+	}
+
+	report.finish()
+	return report
+}
+
+func (c *healthChecker) addPing(report *diagnosticReport, state healthState) {
+	c.mu.Lock()
+	pinged, err := c.pinged, c.pingErr
+	c.mu.Unlock()
+
+	switch {
+	case !state.Initialized || !pinged:
+		report.skip("ping", "Not connected")
+	case err != nil:
+		report.add("ping", false, "%s", err)
+	default:
+		report.add("ping", true, "The database answered")
+	}
+}
+
+func (c *healthChecker) addWriteAge(report *diagnosticReport, state healthState) {
+	if c.maxWriteAge <= 0 || !state.Initialized || state.LastWrite.IsZero() {
+		report.skip("last-write", "Not checked")
+		return
+	}
+
+	age := time.Since(state.LastWrite)
+	report.add("last-write", age <= c.maxWriteAge, "Last successful write was %s ago", age.Round(time.Second))
+}
+
+func (c *healthChecker) handler(check func() diagnosticReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := check()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Success {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealthChecker(t *testing.T) {
+
+	Convey("Given a subscriber which hasn't been initialized", t, func() {
+		health := newHealthChecker(&mariaSubscriber{}, 0, time.Minute)
+		health.ping()
+
+		Convey("Then it should be alive but not ready", func() {
+			So(health.liveness().Success, ShouldBeTrue)
+			So(health.readiness().Success, ShouldBeFalse)
+
+			w := httptest.NewRecorder()
+			health.handler(health.readiness)(w, httptest.NewRequest("GET", "/readyz", nil))
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+
+	Convey("Given an initialized subscriber", t, func() {
+		sub, _ := newTestSubscriber(&settings{DeadLetterBudget: 2})
+		health := newHealthChecker(sub, 0, time.Minute)
+		health.ping()
+
+		Convey("Then it should be ready", func() {
+			So(health.readiness().Success, ShouldBeTrue)
+
+			w := httptest.NewRecorder()
+			health.handler(health.readiness)(w, httptest.NewRequest("GET", "/readyz", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("When the dead letter budget is used up", func() {
+			sub.summary.DeadLettered = 3
+
+			Convey("Then it should not be ready", func() {
+				So(health.readiness().Success, ShouldBeFalse)
+				So(health.liveness().Success, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the last write is too old", func() {
+			sub.summary.LastWrite = time.Now().Add(-time.Hour).UnixNano()
+
+			Convey("Then it should not be ready, but still be alive", func() {
+				So(health.readiness().Success, ShouldBeFalse)
+				So(health.liveness().Success, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the database can't be pinged", func() {
+			sub.db.Close()
+			health.ping()
+
+			Convey("Then it should not be ready, but still be alive", func() {
+				So(health.readiness().Success, ShouldBeFalse)
+				So(health.liveness().Success, ShouldBeTrue)
+			})
+		})
+
+		Convey("When Init or Dispose holds the lock", func() {
+			sub.mu.Lock()
+			defer sub.mu.Unlock()
+
+			Convey("Then the probes should answer without waiting for it", func() {
+				done := make(chan bool)
+				go func() {
+					health.ping()
+					done <- health.liveness().Success && health.readiness().Success
+				}()
+
+				select {
+				case ready := <-done:
+					So(ready, ShouldBeTrue)
+				case <-time.After(time.Second):
+					t.Error("the probes waited for the lock")
+				}
+			})
+		})
+
+		Convey("When the subscriber is disposed", func() {
+			_, err := sub.Dispose(protocol.DisposeRequest{})
+			So(err, ShouldBeNil)
+
+			Convey("Then it should no longer be ready", func() {
+				So(health.readiness().Success, ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	discoverFlags        settingsFlags
+	discoverOutput       string
+	testConnectionFlags  settingsFlags
+	testConnectionOutput string
+)
+
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Prints the shapes of the tables in the database",
+	Long: `Prints the shapes Navigator would discover in the database, the same way
+DiscoverShapes does. Exits with 1 if they can't be discovered.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutputFormat(discoverOutput); err != nil {
+			return err
+		}
+
+		settingsMap, err := discoverFlags.load()
+		if err != nil {
+			return err
+		}
+
+		subscriber := &mariaSubscriber{
+			knownShapes: newLockedShapeCache(shapeutils.NewShapeCache()),
+		}
+		response, err := subscriber.DiscoverShapes(protocol.DiscoverShapesRequest{Settings: settingsMap})
+		subscriber.Dispose(protocol.DisposeRequest{})
+		if err != nil {
+			return fmt.Errorf("couldn't discover shapes: %s", err)
+		}
+
+		return printShapes(os.Stdout, discoverOutput, response.Shapes)
+	},
+}
+
+var testConnectionCmd = &cobra.Command{
+	Use:   "test-connection",
+	Short: "Checks that the subscriber can connect and write to the database",
+	Long: `Runs the same checks as TestConnection and prints the report.
+Exits with 1 if any check fails, so scripts can gate on it.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutputFormat(testConnectionOutput); err != nil {
+			return err
+		}
+
+		settingsMap, err := testConnectionFlags.load()
+		if err != nil {
+			return err
+		}
+
+		// The report has the connection error, if there is one.
+		response, _ := (&mariaSubscriber{}).TestConnection(protocol.TestConnectionRequest{Settings: settingsMap})
+
+		var report diagnosticReport
+		if err = json.Unmarshal([]byte(response.Message), &report); err != nil {
+			return fmt.Errorf("couldn't read the connection report: %s", err)
+		}
+
+		if err = printReport(os.Stdout, testConnectionOutput, report); err != nil {
+			return err
+		}
+		if !report.Success {
+			return errors.New("connection test failed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	discoverFlags.register(discoverCmd)
+	discoverCmd.Flags().StringVarP(&discoverOutput, "output", "o", "json", "output format: json or table")
+	RootCmd.AddCommand(discoverCmd)
+
+	testConnectionFlags.register(testConnectionCmd)
+	testConnectionCmd.Flags().StringVarP(&testConnectionOutput, "output", "o", "json", "output format: json or table")
+	RootCmd.AddCommand(testConnectionCmd)
+}
+
+func checkOutputFormat(format string) error {
+	if format != "json" && format != "table" {
+		return fmt.Errorf("unknown output format %q, expected json or table", format)
+	}
+	return nil
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printShapes prints shapes sorted by name, with a table row for each property.
+func printShapes(w io.Writer, format string, shapes pipeline.ShapeDefinitions) error {
+	sorted := append(pipeline.ShapeDefinitions{}, shapes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	if format == "json" {
+		return printJSON(w, sorted)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHAPE\tPROPERTY\tTYPE\tKEY")
+	for _, shape := range sorted {
+		keys := map[string]bool{}
+		for _, k := range shape.Keys {
+			keys[k] = true
+		}
+		for _, p := range shape.Properties {
+			key := ""
+			if keys[p.Name] {
+				key = "yes"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", shape.Name, p.Name, p.Type, key)
+		}
+	}
+	return tw.Flush()
+}
+
+// printReport prints a TestConnection report, with a table row for each check.
+func printReport(w io.Writer, format string, report diagnosticReport) error {
+	if format == "json" {
+		return printJSON(w, report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if report.Server != "" {
+		fmt.Fprintf(tw, "Server: %s\n\n", report.Server)
+	}
+	fmt.Fprintln(tw, "CHECK\tRESULT\tMESSAGE")
+	for _, c := range report.Checks {
+		result := "passed"
+		switch {
+		case c.Skipped:
+			result = "skipped"
+		case !c.Passed:
+			result = "FAILED"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name, result, strings.Replace(c.Message, "\n", " ", -1))
+	}
+	return tw.Flush()
+}
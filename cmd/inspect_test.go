@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInspectOutput(t *testing.T) {
+
+	Convey("Given discovered shapes", t, func() {
+		shapes := pipeline.ShapeDefinitions{
+			{
+				Name:       "Test.Products",
+				Keys:       []string{"ID"},
+				Properties: []pipeline.PropertyDefinition{{Name: "ID", Type: "integer"}, {Name: "Name", Type: "string"}},
+			},
+			{
+				Name:       "Test.Orders",
+				Keys:       []string{"ID"},
+				Properties: []pipeline.PropertyDefinition{{Name: "ID", Type: "integer"}},
+			},
+		}
+
+		Convey("When they're printed as a table", func() {
+			var out bytes.Buffer
+			So(printShapes(&out, "table", shapes), ShouldBeNil)
+
+			Convey("Then there should be a sorted row for each property", nil)
+			So(out.String(), ShouldEqual, ""+
+				"SHAPE          PROPERTY  TYPE     KEY\n"+
+				"Test.Orders    ID        integer  yes\n"+
+				"Test.Products  ID        integer  yes\n"+
+				"Test.Products  Name      string   \n")
+		})
+
+		Convey("When they're printed as JSON", func() {
+			var out bytes.Buffer
+			So(printShapes(&out, "json", shapes), ShouldBeNil)
+
+			Convey("Then they should decode to the same shapes", nil)
+			var decoded pipeline.ShapeDefinitions
+			So(json.Unmarshal(out.Bytes(), &decoded), ShouldBeNil)
+			So(decoded, ShouldHaveLength, 2)
+			So(decoded[0].Name, ShouldEqual, "Test.Orders")
+		})
+	})
+
+	Convey("Given a connection report", t, func() {
+		var report diagnosticReport
+		report.add("connect", true, "Connected")
+		report.add("grants", false, "Missing ALTER")
+		report.skip("scratch-write", "Set testWrites")
+		report.finish()
+
+		Convey("When it's printed as a table", func() {
+			var out bytes.Buffer
+			So(printReport(&out, "table", report), ShouldBeNil)
+
+			Convey("Then each check should have its result", nil)
+			So(out.String(), ShouldContainSubstring, "grants         FAILED   Missing ALTER")
+			So(out.String(), ShouldContainSubstring, "scratch-write  skipped  Set testWrites")
+		})
+	})
+
+	Convey("An unknown output format should be rejected", t, func() {
+		So(checkOutputFormat("yaml"), ShouldNotBeNil)
+		So(checkOutputFormat("table"), ShouldBeNil)
+	})
+}
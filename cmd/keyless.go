@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// How a table is keyed when its shape has no keys, and none are declared in settings.
+const (
+	// keylessNone creates the table without a primary key, so every write is an insert.
+	keylessNone = "none"
+	// keylessAutoIncrement adds an AUTO_INCREMENT surrogate key.
+	keylessAutoIncrement = "autoincrement"
+	// keylessSequence adds a surrogate key filled from a sequence, from MariaDB 10.3.
+	keylessSequence = "sequence"
+	// keylessHash keys records by a hash of their content, so a record sent again
+	// updates the stored one instead of adding a duplicate.
+	keylessHash = "hash"
+)
+
+const (
+	// surrogateKeyColumn is filled in by the server with the autoincrement and sequence strategies.
+	surrogateKeyColumn = "naveegoId"
+	// contentHashColumn holds the SHA-256 of a record's properties with the hash strategy.
+	contentHashColumn = "naveegoContentHash"
+	// keySequenceName is the sequence all tables draw surrogate keys from.
+	keySequenceName = "naveego_key_sequence"
+)
+
+const createKeySequenceSQL = "CREATE SEQUENCE IF NOT EXISTS `" + keySequenceName + "`"
+
+func newKeylessStrategy(strategy string) (string, error) {
+	strategy = strings.ToLower(strategy)
+	switch strategy {
+	case "":
+		return keylessNone, nil
+	case keylessNone, keylessAutoIncrement, keylessSequence, keylessHash:
+		return strategy, nil
+	}
+	return "", settingsError{"keylessShapes", fmt.Sprintf("%q is not one of none, autoincrement, sequence or hash", strategy)}
+}
+
+// checkKeyless checks that the server supports the keyless strategy.
+func (o *sqlOptions) checkKeyless(d dialect) error {
+	if o.Keyless == keylessSequence && !d.Features().Sequences {
+		return settingsError{"keylessShapes", "sequence needs CREATE SEQUENCE, from MariaDB 10.3"}
+	}
+	return nil
+}
+
+// surrogateKey returns the key column the keyless strategy adds, and its property type.
+func (o *sqlOptions) surrogateKey() (string, string, bool) {
+	switch o.Keyless {
+	case keylessAutoIncrement, keylessSequence:
+		return surrogateKeyColumn, "integer", true
+	case keylessHash:
+		return contentHashColumn, "string", true
+	}
+	return "", "", false
+}
+
+// addSurrogateKey keys a new shape without keys with the keyless strategy's column.
+func (o *sqlOptions) addSurrogateKey(delta *shapeutils.ShapeDelta) {
+	if !delta.IsNew || len(delta.NewKeys) > 0 {
+		return
+	}
+	column, propertyType, ok := o.surrogateKey()
+	if !ok {
+		return
+	}
+
+	properties := make(map[string]string, len(delta.NewProperties)+1)
+	for n, t := range delta.NewProperties {
+		properties[n] = t
+	}
+	properties[column] = propertyType
+	delta.NewProperties = properties
+	delta.NewKeys = []string{column}
+}
+
+// isSurrogate reports whether a column is the one the keyless strategy adds. The
+// strategy only adds it as a key, so a property of the same name which isn't a key,
+// or any property when the strategy is off, is an ordinary column.
+func (o *sqlOptions) isSurrogate(column string, isKey bool) bool {
+	surrogate, _, ok := o.surrogateKey()
+	return ok && isKey && column == surrogate
+}
+
+// surrogateSQLType returns the column type of the keyless strategy's columns.
+func (o *sqlOptions) surrogateSQLType(property string, isKey bool) (string, bool) {
+	if !o.isSurrogate(property, isKey) {
+		return "", false
+	}
+	switch property {
+	case surrogateKeyColumn:
+		if o.Keyless == keylessSequence {
+			return "BIGINT DEFAULT NEXT VALUE FOR `" + keySequenceName + "`", true
+		}
+		return "BIGINT AUTO_INCREMENT", true
+	case contentHashColumn:
+		return "CHAR(64)", true
+	}
+	return "", false
+}
+
+// surrogateKeyFirst moves the surrogate key to the front of keys, as an
+// AUTO_INCREMENT column must lead the primary key when keys are added later.
+func (o *sqlOptions) surrogateKeyFirst(keys []string) []string {
+	for i, k := range keys {
+		if k == surrogateKeyColumn && i > 0 && o.isSurrogate(k, true) {
+			ordered := append([]string{k}, keys[:i]...)
+			return append(ordered, keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+// withoutSurrogateKey returns keys without the server-filled surrogate key.
+func (o *sqlOptions) withoutSurrogateKey(keys []string) []string {
+	var out []string
+	for _, k := range keys {
+		if !o.serverFilled(k, true) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// serverFilled reports whether a column is the surrogate key the server fills in.
+func (o *sqlOptions) serverFilled(column string, isKey bool) bool {
+	return column == surrogateKeyColumn && o.isSurrogate(column, isKey)
+}
+
+// declareKeys sets the keys declared in the shapeKeys setting on a data point
+// whose shape has none. The setting is keyed by shape name.
+func (o *sqlOptions) declareKeys(dp pipeline.DataPoint) (pipeline.DataPoint, error) {
+	if len(dp.Shape.KeyNames) > 0 || len(o.ShapeKeys) == 0 {
+		return dp, nil
+	}
+	name := shapeutils.NewKnownShape(dp).Name
+	keys, ok := o.ShapeKeys[name]
+	if !ok {
+		return dp, nil
+	}
+
+	properties := map[string]bool{}
+	for _, p := range dp.Shape.Properties {
+		properties[propertyName(p)] = true
+	}
+	for _, k := range keys {
+		if !properties[k] {
+			return dp, fmt.Errorf("key %q declared for shape %s isn't one of its properties", k, name)
+		}
+	}
+
+	dp.Shape.KeyNames = append([]string(nil), keys...)
+	return dp, nil
+}
+
+// propertyName returns the name of a "name:type" shape property.
+func propertyName(property string) string {
+	if i := strings.LastIndex(property, ":"); i >= 0 {
+		return property[:i]
+	}
+	return property
+}
+
+// contentHash returns the hex SHA-256 of the data point's properties, by name,
+// so the same record always has the same hash whatever else is in its table.
+func contentHash(dp pipeline.DataPoint) (string, error) {
+	var names []string
+	for _, p := range dp.Shape.Properties {
+		names = append(names, propertyName(p))
+	}
+	if len(names) == 0 {
+		for n := range dp.Data {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, n := range names {
+		value, err := json.Marshal(dp.Data[n])
+		if err != nil {
+			return "", fmt.Errorf("couldn't hash property %s: %s", n, err)
+		}
+		h.Write([]byte(n))
+		h.Write([]byte{0})
+		h.Write(value)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// columnValue returns the value written to a column for a data point.
+func (o *sqlOptions) columnValue(dp pipeline.DataPoint, column string, isKey bool) (interface{}, error) {
+	if column == contentHashColumn && o.isSurrogate(column, isKey) {
+		return contentHash(dp)
+	}
+	return dp.Data[column], nil
+}
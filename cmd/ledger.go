@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const createRunsTableSQL = "CREATE TABLE IF NOT EXISTS `naveego_runs` (\n" +
+	"\t`id` BIGINT NOT NULL AUTO_INCREMENT,\n" +
+	"\t`run_id` VARCHAR(64) NOT NULL,\n" +
+	"\t`started_at` DATETIME(6) NOT NULL,\n" +
+	"\t`ended_at` DATETIME(6) NULL,\n" +
+	"\t`status` VARCHAR(20) NOT NULL,\n" +
+	"\t`received` BIGINT NOT NULL DEFAULT 0,\n" +
+	"\t`failed` BIGINT NOT NULL DEFAULT 0,\n" +
+	"\t`dead_lettered` BIGINT NOT NULL DEFAULT 0,\n" +
+	"\t`shapes` LONGTEXT NULL,\n" +
+	"\t`ddl` LONGTEXT NULL,\n" +
+	"\t`message` TEXT NULL,\n" +
+	"\tPRIMARY KEY (`id`),\n" +
+	"\tKEY (`run_id`)\n" +
+	")"
+
+const insertRunSQL = "INSERT INTO `naveego_runs` (`run_id`, `started_at`, `status`) VALUES (?, ?, ?)"
+
+const updateRunSQL = "UPDATE `naveego_runs` SET `ended_at` = ?, `status` = ?, `received` = ?, `failed` = ?,\n" +
+	"\t`dead_lettered` = ?, `shapes` = ?, `ddl` = ?, `message` = ? WHERE `id` = ?"
+
+// Run statuses in the ledger.
+const (
+	runRunning   = "running"
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+)
+
+// startRun records the start of a run in the ledger. The ledger is bookkeeping,
+// so a run goes ahead without it if it can't be written.
+func (h *mariaSubscriber) startRun(runID string) {
+	h.ledgerID = 0
+
+	if _, err := h.db.Exec(createRunsTableSQL); err != nil {
+		logrus.WithError(err).Warn("Couldn't create the run ledger table; the run won't be recorded")
+		return
+	}
+
+	result, err := h.db.Exec(insertRunSQL, runID, h.summary.Started.UTC().Format(checkpointTimeFormat), runRunning)
+	if err == nil {
+		h.ledgerID, err = result.LastInsertId()
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("Couldn't record the run in the ledger")
+	}
+}
+
+// finishRun records the outcome of the run in the ledger.
+func (h *mariaSubscriber) finishRun(status, message string) {
+	if h.ledgerID == 0 {
+		return
+	}
+
+	shapes, _ := json.Marshal(h.summary.shapeCounts())
+	ddl, _ := json.Marshal(h.summary.appliedDDL())
+
+	_, err := h.db.Exec(updateRunSQL,
+		time.Now().UTC().Format(checkpointTimeFormat), status,
+		atomic.LoadInt64(&h.summary.Received), atomic.LoadInt64(&h.summary.Failed), h.summary.deadLettered(),
+		string(shapes), string(ddl), message, h.ledgerID)
+	if err != nil {
+		logrus.WithError(err).Warn("Couldn't record the end of the run in the ledger")
+	}
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// maxLoadLineSize is the longest JSONL line load accepts.
+const maxLoadLineSize = 64 * 1024 * 1024
+
+var (
+	loadFlags    settingsFlags
+	loadProgress bool
+	loadFailFast bool
+)
+
+var loadCmd = &cobra.Command{
+	Use:   "load [file]",
+	Short: "Writes data points from a JSONL file to the database",
+	Long: `Reads data points, one JSON object per line, from a file or from stdin
+when the file is "-" or not given, and writes them the same way the subscriber
+writes data points it receives from Navigator.
+
+Use it to backfill, to replay captured data points and to seed test databases.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		settingsMap, err := loadFlags.load()
+		if err != nil {
+			return err
+		}
+
+		input := os.Stdin
+		if len(args) == 1 && args[0] != "-" {
+			input, err = os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer input.Close()
+		}
+
+		subscriber := &mariaSubscriber{
+			knownShapes: newLockedShapeCache(shapeutils.NewShapeCache()),
+		}
+
+		opts := loadOptions{failFast: loadFailFast}
+		if loadProgress {
+			opts.progress = os.Stderr
+		}
+
+		result, err := load(subscriber, settingsMap, input, opts)
+		fmt.Println(result.message)
+		if err != nil {
+			return err
+		}
+		if result.failed > 0 {
+			return fmt.Errorf("%d of %d data points failed", result.failed, result.received)
+		}
+		return nil
+	},
+}
+
+func init() {
+	loadFlags.register(loadCmd)
+	loadCmd.Flags().BoolVar(&loadProgress, "progress", false, "print progress to stderr")
+	loadCmd.Flags().BoolVar(&loadFailFast, "fail-fast", false, "stop at the first data point which can't be written")
+	RootCmd.AddCommand(loadCmd)
+}
+
+type loadOptions struct {
+	failFast bool
+	progress io.Writer // Receives a progress line every progressInterval, if set
+}
+
+// progressInterval is how often load reports progress.
+const progressInterval = time.Second
+
+type loadResult struct {
+	received int
+	failed   int
+	message  string // The Dispose message
+}
+
+// load sends the JSONL data points read from r to sub, between Init and Dispose.
+// Data points which can't be parsed or written are logged and counted; with
+// failFast the first one stops the load. Dispose is called in every case.
+func load(sub protocol.Subscriber, settingsMap map[string]interface{}, r io.Reader, opts loadOptions) (loadResult, error) {
+	var result loadResult
+
+	initResponse, err := sub.Init(protocol.InitRequest{Settings: settingsMap})
+	if err == nil && !initResponse.Success {
+		err = fmt.Errorf("init failed: %s", initResponse.Message)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	loadErr := receiveAll(sub, r, opts, &result)
+
+	disposeResponse, err := sub.Dispose(protocol.DisposeRequest{})
+	result.message = disposeResponse.Message
+	if loadErr != nil {
+		return result, loadErr
+	}
+	return result, err
+}
+
+func receiveAll(sub protocol.Subscriber, r io.Reader, opts loadOptions, result *loadResult) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLoadLineSize)
+
+	lastProgress := time.Now()
+	defer func() {
+		if opts.progress != nil {
+			fmt.Fprintf(opts.progress, "%d data points, %d failed\n", result.received, result.failed)
+		}
+	}()
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		result.received++
+		if err := receiveLine(sub, scanner.Bytes()); err != nil {
+			result.failed++
+			err = fmt.Errorf("line %d: %s", line, err)
+			if opts.failFast {
+				return err
+			}
+			logrus.WithError(err).Error("Couldn't load data point")
+		}
+
+		if opts.progress != nil && time.Since(lastProgress) >= progressInterval {
+			fmt.Fprintf(opts.progress, "%d data points, %d failed\n", result.received, result.failed)
+			lastProgress = time.Now()
+		}
+	}
+
+	return scanner.Err()
+}
+
+func receiveLine(sub protocol.Subscriber, data []byte) error {
+	var dp pipeline.DataPoint
+	if err := json.Unmarshal(data, &dp); err != nil {
+		return fmt.Errorf("couldn't parse data point: %s", err)
+	}
+
+	response, err := sub.ReceiveDataPoint(protocol.ReceiveShapeRequest{DataPoint: dp})
+	if err == nil && !response.Success {
+		err = fmt.Errorf("data point was not written: %s", response.Message)
+	}
+	return err
+}
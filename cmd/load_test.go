@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoad(t *testing.T) {
+
+	Convey("Given a subscriber and JSONL data points", t, func() {
+		sub, fake := newTestSubscriber(&settings{})
+
+		input := strings.Join([]string{
+			`{"source":"Test","entity":"Products","shape":{"keyNames":["ID"],"properties":["ID:integer","Name:string"]},"data":{"ID":1,"Name":"First"}}`,
+			``,
+			`not json`,
+			`{"source":"Test","entity":"Products","shape":{"keyNames":["ID"],"properties":["ID:integer","Name:string"]},"data":{"ID":2,"Name":"Second"}}`,
+		}, "\n")
+
+		Convey("When the data points are loaded", func() {
+			var progress bytes.Buffer
+			result, err := load(sub, nil, strings.NewReader(input), loadOptions{progress: &progress})
+
+			Convey("Then the valid data points should be written and the others counted", nil)
+			So(err, ShouldBeNil)
+			So(result.received, ShouldEqual, 3)
+			So(result.failed, ShouldEqual, 1)
+			So(sub.summary.Received, ShouldEqual, 2)
+			So(result.message, ShouldStartWith, "Closed connection.")
+			So(progress.String(), ShouldContainSubstring, "3 data points, 1 failed")
+		})
+
+		Convey("When the data points are loaded with failFast", func() {
+			result, err := load(sub, nil, strings.NewReader(input), loadOptions{failFast: true})
+
+			Convey("Then the load should stop at the first failure", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "line 3:")
+			So(result.received, ShouldEqual, 2)
+
+			Convey("Then the subscriber should still be disposed", nil)
+			So(sub.db, ShouldBeNil)
+		})
+
+		Convey("When a data point can't be written", func() {
+			fake.fail = func(query string, args []driver.Value) error {
+				if strings.HasPrefix(query, "INSERT INTO `Test.Products`") {
+					return errors.New("Table is read only")
+				}
+				return nil
+			}
+			result, err := load(sub, nil, strings.NewReader(input), loadOptions{})
+
+			Convey("Then it should be counted as failed", nil)
+			So(err, ShouldBeNil)
+			So(result.failed, ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"sync"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// lockedShapeCache makes a shapeutils.ShapeCache safe for concurrent use.
+type lockedShapeCache struct {
+	mu    sync.Mutex
+	cache shapeutils.ShapeCache
+}
+
+func newLockedShapeCache(cache shapeutils.ShapeCache) *lockedShapeCache {
+	return &lockedShapeCache{cache: cache}
+}
+
+func (c *lockedShapeCache) GetKnownShape(dp pipeline.DataPoint) (*shapeutils.KnownShape, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.GetKnownShape(dp)
+}
+
+func (c *lockedShapeCache) Analyze(dp pipeline.DataPoint) shapeutils.ShapeDelta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.Analyze(dp)
+}
+
+func (c *lockedShapeCache) ApplyDelta(delta shapeutils.ShapeDelta) *shapeutils.KnownShape {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.ApplyDelta(delta)
+}
+
+func (c *lockedShapeCache) GetAllShapeDefinitions() pipeline.ShapeDefinitions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.GetAllShapeDefinitions()
+}
+
+// knownShapeItems guards the items stored on known shapes with Get and Set,
+// which aren't safe for concurrent use.
+var knownShapeItems sync.Mutex
+
+func getShapeItem(shape *shapeutils.KnownShape, key string) (interface{}, bool) {
+	knownShapeItems.Lock()
+	defer knownShapeItems.Unlock()
+	return shape.Get(key)
+}
+
+func setShapeItem(shape *shapeutils.KnownShape, key string, value interface{}) {
+	knownShapeItems.Lock()
+	defer knownShapeItems.Unlock()
+	shape.Set(key, value)
+}
+
+// shapeLocks serializes the schema changes for each shape.
+type shapeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the shape and returns the function unlocking it.
+func (l *shapeLocks) lock(shape string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*sync.Mutex{}
+	}
+	m, ok := l.locks[shape]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[shape] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Logging flags, shared by all commands.
+var (
+	verbose           bool
+	logLevel          string
+	logFormat         string
+	logFile           string
+	logFileMaxSize    int
+	logFileMaxBackups int
+)
+
+// configureLogging sets up logrus from the logging flags.
+func configureLogging() error {
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %s", err)
+	}
+	if verbose {
+		level = logrus.DebugLevel
+	}
+
+	var formatter logrus.Formatter
+	switch strings.ToLower(logFormat) {
+	case "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid --log-format %q: must be json or text", logFormat)
+	}
+
+	if logFile == "" {
+		logrus.SetOutput(os.Stdout)
+	} else {
+		logrus.SetOutput(&lumberjack.Logger{
+			Filename:   logFile,
+			MaxSize:    logFileMaxSize,
+			MaxBackups: logFileMaxBackups,
+		})
+	}
+
+	logrus.SetLevel(level)
+	logrus.SetFormatter(&runFormatter{Formatter: &redactingFormatter{Formatter: formatter}})
+
+	return nil
+}
+
+var currentRunID atomic.Value
+
+// setRunID sets the correlation ID added to every log line; "" removes it.
+func setRunID(id string) {
+	currentRunID.Store(id)
+}
+
+func runID() string {
+	id, _ := currentRunID.Load().(string)
+	return id
+}
+
+// newRunID returns a random correlation ID for a run which wasn't given one.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// runFormatter adds the run's correlation ID to entries
+// before handing them to the underlying formatter.
+type runFormatter struct {
+	logrus.Formatter
+}
+
+func (f *runFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	id := runID()
+	if id == "" {
+		return f.Formatter.Format(entry)
+	}
+
+	withRun := *entry
+	withRun.Data = make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		withRun.Data[k] = v
+	}
+	withRun.Data["run"] = id
+
+	return f.Formatter.Format(&withRun)
+}
+
+// dataPointLog returns the logger for the work done on a data point.
+func dataPointLog(shape string, dp pipeline.DataPoint) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"shape":     shape,
+		"publisher": dp.Meta["publisher"],
+	})
+}
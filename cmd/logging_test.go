@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigureLogging(t *testing.T) {
+
+	Convey("Given the logging flags", t, func() {
+		previousLevel, previousFormatter, previousOut := logrus.GetLevel(), logrus.StandardLogger().Formatter, logrus.StandardLogger().Out
+		defer func() {
+			logrus.SetLevel(previousLevel)
+			logrus.SetFormatter(previousFormatter)
+			logrus.SetOutput(previousOut)
+			verbose, logLevel, logFormat = false, "info", "text"
+		}()
+
+		verbose, logLevel, logFormat = false, "warn", "json"
+
+		Convey("When they are valid", func() {
+			So(configureLogging(), ShouldBeNil)
+
+			Convey("Then the level and format should be used", nil)
+			So(logrus.GetLevel(), ShouldEqual, logrus.WarnLevel)
+			So(logrus.StandardLogger().Formatter.(*runFormatter).Formatter.(*redactingFormatter).Formatter, ShouldHaveSameTypeAs, &logrus.JSONFormatter{})
+		})
+
+		Convey("When verbose is set", func() {
+			verbose = true
+			So(configureLogging(), ShouldBeNil)
+
+			Convey("Then debug logging should be on", nil)
+			So(logrus.GetLevel(), ShouldEqual, logrus.DebugLevel)
+		})
+
+		Convey("When the format is unknown", func() {
+			logFormat = "xml"
+
+			Convey("Then it should fail", nil)
+			So(configureLogging(), ShouldNotBeNil)
+		})
+
+		Convey("When the level is unknown", func() {
+			logLevel = "loud"
+
+			Convey("Then it should fail", nil)
+			So(configureLogging(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRunFormatter(t *testing.T) {
+
+	Convey("Given a run ID", t, func() {
+		setRunID("abc123")
+		defer setRunID("")
+
+		f := &runFormatter{Formatter: &logrus.TextFormatter{DisableColors: true}}
+		entry := logrus.WithField("shape", "Test.Products")
+		entry.Message = "hello"
+
+		Convey("Then log lines should carry it without changing the entry", func() {
+			out, err := f.Format(entry)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldContainSubstring, "run=abc123")
+			So(string(out), ShouldContainSubstring, "shape=Test.Products")
+			So(entry.Data, ShouldNotContainKey, "run")
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Version and VersionHash are set by main from the values goreleaser injects.
+var (
+	Version     = "dev"
+	VersionHash = ""
+)
+
+const executableName = "plugin-sub-mariadb"
+
+// pluginManifest is the manifest.json Navigator reads to run the plugin and render its settings.
+type pluginManifest struct {
+	Name               string        `json:"name"`
+	DisplayName        string        `json:"displayName"`
+	Description        string        `json:"description"`
+	VersionDescription string        `json:"versionDescription"`
+	Version            string        `json:"version"`
+	IconFile           string        `json:"iconFile"`
+	Executable         string        `json:"executable"`
+	Kind               string        `json:"kind"`
+	ConfigSchema       []schemaEntry `json:"configSchema"`
+}
+
+// schemaEntry describes a setting in the config UI.
+type schemaEntry struct {
+	Name    string      `json:"name"`
+	Label   string      `json:"label"`
+	Type    string      `json:"type"`
+	Secret  bool        `json:"secret,omitempty"`
+	Enum    []string    `json:"enum,omitempty"`
+	Default interface{} `json:"default,omitempty"`
+	Help    string      `json:"help,omitempty"`
+}
+
+func newManifest(version string) (pluginManifest, error) {
+	schema, err := configSchema(reflect.TypeOf(settings{}))
+	if err != nil {
+		return pluginManifest{}, err
+	}
+
+	return pluginManifest{
+		Name:               "sub-mariadb",
+		DisplayName:        "MariaDB Subscriber",
+		Description:        "Subscriber which pushes data into MariaDB.",
+		VersionDescription: "Version 1",
+		Version:            version,
+		IconFile:           "icon.png",
+		Executable:         executableName,
+		Kind:               "subscriber",
+		ConfigSchema:       schema,
+	}, nil
+}
+
+// configSchema describes the fields of t which have a mapstructure tag.
+func configSchema(t reflect.Type) ([]schemaEntry, error) {
+	var schema []schemaEntry
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("mapstructure")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		entry := schemaEntry{
+			Name:   name,
+			Label:  f.Tag.Get("label"),
+			Type:   f.Tag.Get("type"),
+			Secret: f.Tag.Get("secret") == "true",
+			Help:   f.Tag.Get("help"),
+		}
+		if entry.Type == "" {
+			entry.Type = schemaType(f.Type)
+		}
+		if entry.Label == "" || entry.Type == "" {
+			return nil, fmt.Errorf("setting %s needs label and type tags", f.Name)
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			entry.Enum = strings.Split(enum, ",")
+		}
+		if value, ok := f.Tag.Lookup("default"); ok {
+			var err error
+			if entry.Default, err = schemaDefault(entry.Type, value); err != nil {
+				return nil, fmt.Errorf("setting %s has an invalid default: %s", f.Name, err)
+			}
+		}
+
+		schema = append(schema, entry)
+	}
+
+	return schema, nil
+}
+
+// schemaType is the config schema type for a Go type, or "" if it has none.
+func schemaType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// Durations are entered as strings like "30s".
+		return "string"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "array"
+	case reflect.Map:
+		return "object"
+	}
+	return ""
+}
+
+func schemaDefault(schemaType, value string) (interface{}, error) {
+	switch schemaType {
+	case "number", "integer":
+		return strconv.ParseFloat(value, 64)
+	case "boolean":
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+func (m pluginManifest) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(m); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+var (
+	manifestOutput  string
+	manifestVersion string
+)
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "Generates manifest.json",
+	Long: `Generates manifest.json from the settings the plugin accepts, so the config
+UI always matches them. The version is the plugin's unless --version is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		version := manifestVersion
+		if version == "" {
+			version = Version
+		}
+
+		manifest, err := newManifest(version)
+		if err != nil {
+			return err
+		}
+
+		data, err := manifest.marshal()
+		if err != nil {
+			return err
+		}
+
+		if manifestOutput == "" || manifestOutput == "-" {
+			_, err = fmt.Fprintln(os.Stdout, string(data))
+			return err
+		}
+		return ioutil.WriteFile(manifestOutput, data, 0644)
+	},
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Prints the version of the plugin",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if VersionHash == "" {
+			fmt.Printf("%s %s\n", executableName, Version)
+			return
+		}
+		fmt.Printf("%s %s (%s)\n", executableName, Version, VersionHash)
+	},
+}
+
+func init() {
+	manifestCmd.Flags().StringVarP(&manifestOutput, "output", "o", "", "file to write the manifest to; stdout if not given")
+	manifestCmd.Flags().StringVar(&manifestVersion, "version", "", "version to put in the manifest (default the plugin's)")
+	RootCmd.AddCommand(manifestCmd)
+	RootCmd.AddCommand(versionCmd)
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManifest(t *testing.T) {
+
+	Convey("Given the manifest.json in the repository", t, func() {
+		data, err := ioutil.ReadFile("../manifest.json")
+		So(err, ShouldBeNil)
+
+		var existing pluginManifest
+		So(json.Unmarshal(data, &existing), ShouldBeNil)
+
+		Convey("When the manifest is generated with the same version", func() {
+			manifest, err := newManifest(existing.Version)
+			So(err, ShouldBeNil)
+			generated, err := manifest.marshal()
+			So(err, ShouldBeNil)
+
+			Convey("Then it should be the same; run the manifest command if it isn't", nil)
+			So(string(generated), ShouldEqual, string(data))
+		})
+	})
+
+	Convey("Every setting should be decoded from the name in its schema", t, func() {
+		manifest, err := newManifest("1.0.0")
+		So(err, ShouldBeNil)
+
+		settingsMap := map[string]interface{}{}
+		for _, e := range manifest.ConfigSchema {
+			if e.Default != nil {
+				settingsMap[e.Name] = e.Default
+			}
+		}
+		s, err := decodeSettings(settingsMap)
+		So(err, ShouldBeNil)
+		So(s.Port, ShouldEqual, 3306)
+		So(s.RetryBackoff.String(), ShouldEqual, "100ms")
+		So(s.VersionProperty, ShouldEqual, "naveegoPublishedAt")
+	})
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// Merge rules decide the value of a column when an upsert updates an existing record.
+const (
+	mergeOverwrite   = "overwrite"   // The incoming value, even if it's null. The default.
+	mergeCoalesce    = "coalesce"    // The incoming value, unless it's null.
+	mergeKeepFirst   = "keepfirst"   // The stored value, unless it's null.
+	mergeMax         = "max"         // The greater of the two.
+	mergeMin         = "min"         // The lesser of the two.
+	mergeSum         = "sum"         // The sum of the two, for counters.
+	mergeAppend      = "append"      // The incoming text appended to the stored text.
+	mergeAppendArray = "appendarray" // The incoming JSON array appended to the stored one.
+)
+
+var mergeRules = []string{mergeOverwrite, mergeCoalesce, mergeKeepFirst, mergeMax, mergeMin, mergeSum, mergeAppend, mergeAppendArray}
+
+// newMergeRules checks and normalizes the mergeRules setting. Its keys are
+// property names, or shape/property to apply a rule to one shape.
+func newMergeRules(rules map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(rules))
+	for property, rule := range rules {
+		rule = strings.ToLower(rule)
+		if !isMergeRule(rule) {
+			return nil, settingsError{"mergeRules", fmt.Sprintf("%q for %s is not one of %s", rule, property, strings.Join(mergeRules, ", "))}
+		}
+		normalized[property] = rule
+	}
+	return normalized, nil
+}
+
+func isMergeRule(rule string) bool {
+	for _, r := range mergeRules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeRule returns the rule for a property of a shape.
+func (o *sqlOptions) mergeRule(shape, property string) string {
+	if rule, ok := o.MergeRules[shape+"/"+property]; ok {
+		return rule
+	}
+	if rule, ok := o.MergeRules[property]; ok {
+		return rule
+	}
+	return mergeOverwrite
+}
+
+// accumulates reports whether rule adds the incoming value to the stored one,
+// so that applying an update twice isn't the same as applying it once.
+func accumulates(rule string) bool {
+	switch rule {
+	case mergeSum, mergeAppend, mergeAppendArray:
+		return true
+	}
+	return false
+}
+
+// idempotent reports whether writing a data point of shape twice leaves the
+// same record as writing it once.
+func (o *sqlOptions) idempotent(shape *shapeutils.KnownShape) bool {
+	for _, p := range shape.Properties {
+		if accumulates(o.mergeRule(shape.Name, p.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMergeRules checks that the server supports the functions the merge rules use.
+func (o *sqlOptions) checkMergeRules(d dialect) error {
+	var properties []string
+	for property, rule := range o.MergeRules {
+		if rule == mergeAppendArray && !d.Features().JSONMergePreserve {
+			properties = append(properties, property)
+		}
+	}
+	if len(properties) > 0 {
+		sort.Strings(properties)
+		return settingsError{"mergeRules", fmt.Sprintf("appendarray for %s needs JSON_MERGE_PRESERVE, from MariaDB 10.2.25 or MySQL 5.7.22",
+			strings.Join(properties, ", "))}
+	}
+	return nil
+}
+
+// mergeValue renders the value assigned to column by rule, given the incoming value.
+// A null on either side leaves the other, except with overwrite.
+func mergeValue(rule, column, incoming string) string {
+	stored := "`" + column + "`"
+
+	switch rule {
+	case mergeCoalesce:
+		return fmt.Sprintf("COALESCE(%s, %s)", incoming, stored)
+	case mergeKeepFirst:
+		return fmt.Sprintf("COALESCE(%s, %s)", stored, incoming)
+	case mergeMax:
+		return fmt.Sprintf("GREATEST(COALESCE(%[1]s, %[2]s), COALESCE(%[2]s, %[1]s))", stored, incoming)
+	case mergeMin:
+		return fmt.Sprintf("LEAST(COALESCE(%[1]s, %[2]s), COALESCE(%[2]s, %[1]s))", stored, incoming)
+	case mergeSum:
+		return fmt.Sprintf("COALESCE(%[1]s + %[2]s, %[1]s, %[2]s)", stored, incoming)
+	case mergeAppend:
+		return fmt.Sprintf("COALESCE(CONCAT(%[1]s, %[2]s), %[1]s, %[2]s)", stored, incoming)
+	case mergeAppendArray:
+		return fmt.Sprintf("COALESCE(JSON_MERGE_PRESERVE(%[1]s, %[2]s), %[1]s, %[2]s)", stored, incoming)
+	}
+	return incoming
+}
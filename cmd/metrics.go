@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "sub_mariadb"
+
+// pluginMetrics are the Prometheus metrics of the subscriber.
+type pluginMetrics struct {
+	registry *prometheus.Registry
+
+	received      *prometheus.CounterVec
+	inserted      *prometheus.CounterVec
+	updated       *prometheus.CounterVec
+	failed        *prometheus.CounterVec
+	deadLettered  *prometheus.CounterVec
+	retries       *prometheus.CounterVec
+	ddl           *prometheus.CounterVec
+	upsertSeconds *prometheus.HistogramVec
+	pool          *dbStatsCollector
+}
+
+// metrics is the process's metrics. They're served when --metrics-addr is set.
+var metrics = newPluginMetrics()
+
+func newPluginMetrics() *pluginMetrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"shape"})
+	}
+
+	m := &pluginMetrics{
+		registry:     prometheus.NewRegistry(),
+		received:     counter("rows_received_total", "Data points received."),
+		inserted:     counter("rows_inserted_total", "Rows inserted."),
+		updated:      counter("rows_updated_total", "Existing rows updated."),
+		failed:       counter("rows_failed_total", "Data points which couldn't be written."),
+		deadLettered: counter("rows_dead_lettered_total", "Data points moved to the dead letter table."),
+		retries:      counter("write_retries_total", "Writes retried after a transient error."),
+		ddl:          counter("ddl_statements_total", "CREATE and ALTER statements executed."),
+		upsertSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upsert_duration_seconds",
+			Help:      "Time taken to write a data point, including retries.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"shape"}),
+		pool: newDBStatsCollector(),
+	}
+
+	m.registry.MustRegister(m.received, m.inserted, m.updated, m.failed, m.deadLettered,
+		m.retries, m.ddl, m.upsertSeconds, m.pool)
+
+	return m
+}
+
+// wrote records a successful upsert. MySQL reports 1 affected row for an insert,
+// 2 for an update and 0 if the row already had the values.
+func (m *pluginMetrics) wrote(shape string, result sql.Result, elapsed time.Duration) {
+	m.upsertSeconds.WithLabelValues(shape).Observe(elapsed.Seconds())
+
+	if result == nil {
+		return
+	}
+	switch n, _ := result.RowsAffected(); n {
+	case 1:
+		m.inserted.WithLabelValues(shape).Inc()
+	case 2:
+		m.updated.WithLabelValues(shape).Inc()
+	}
+}
+
+func (m *pluginMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// dbStatsCollector reports the connection pool statistics of the current connection.
+type dbStatsCollector struct {
+	mu sync.Mutex
+	db *sql.DB
+
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+func newDBStatsCollector() *dbStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "pool", name), help, nil, nil)
+	}
+
+	return &dbStatsCollector{
+		maxOpen:      desc("max_open_connections", "Maximum number of open connections."),
+		open:         desc("open_connections", "Established connections, in use and idle."),
+		inUse:        desc("in_use_connections", "Connections in use."),
+		idle:         desc("idle_connections", "Idle connections."),
+		waitCount:    desc("wait_count_total", "Times a connection had to be waited for."),
+		waitDuration: desc("wait_duration_seconds_total", "Time spent waiting for a connection."),
+	}
+}
+
+// setDB sets the connection to report on; nil stops reporting.
+func (c *dbStatsCollector) setDB(db *sql.DB) {
+	c.mu.Lock()
+	c.db = db
+	c.mu.Unlock()
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	db := c.db
+	c.mu.Unlock()
+
+	if db == nil {
+		return
+	}
+
+	stats := db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// gathered returns the value of the metric called name with the given shape label, or
+// of the unlabelled metric if shape is empty. It returns -1 if there is no such metric.
+func gathered(m *pluginMetrics, name, shape string) float64 {
+	families, _ := m.registry.Gather()
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			matches := shape == ""
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "shape" && l.GetValue() == shape {
+					matches = true
+				}
+			}
+			if !matches {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return -1
+}
+
+func TestPluginMetrics(t *testing.T) {
+
+	Convey("Given the plugin metrics", t, func() {
+		m := newPluginMetrics()
+
+		Convey("When writes are recorded", func() {
+			m.wrote("Test.Products", driver.RowsAffected(1), time.Millisecond)
+			m.wrote("Test.Products", driver.RowsAffected(2), time.Millisecond)
+			m.wrote("Test.Products", driver.RowsAffected(0), time.Millisecond)
+
+			Convey("Then inserts and updates should be told apart by the rows affected", nil)
+			So(gathered(m, "sub_mariadb_rows_inserted_total", "Test.Products"), ShouldEqual, 1)
+			So(gathered(m, "sub_mariadb_rows_updated_total", "Test.Products"), ShouldEqual, 1)
+
+			Convey("Then every write should be timed", nil)
+			So(gathered(m, "sub_mariadb_upsert_duration_seconds", "Test.Products"), ShouldEqual, 3)
+		})
+
+		Convey("When there is a connection", func() {
+			db, _ := newFakeDB()
+			defer db.Close()
+			db.SetMaxOpenConns(7)
+			m.pool.setDB(db)
+
+			Convey("Then the pool statistics should be reported", nil)
+			So(gathered(m, "sub_mariadb_pool_max_open_connections", ""), ShouldEqual, 7)
+
+			m.pool.setDB(nil)
+			So(gathered(m, "sub_mariadb_pool_max_open_connections", ""), ShouldEqual, -1)
+		})
+	})
+}
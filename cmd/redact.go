@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// credentialFields are log fields which are always masked.
+var credentialFields = map[string]bool{
+	"password":       true,
+	"dsn":            true,
+	"datasourcename": true,
+	"settings":       true,
+}
+
+// dataFields are log fields which carry customer data values.
+// They are masked unless logging data values has been allowed.
+var dataFields = map[string]bool{
+	"request":    true,
+	"data":       true,
+	"params":     true,
+	"parameters": true,
+	"statements": true,
+	"value":      true,
+}
+
+// dsnPassword matches the password in "user:password@..." connection strings.
+var dsnPassword = regexp.MustCompile(`([^\s:/@"'=]+):[^\s@]*@`)
+
+// errorValues match the values the server quotes in its errors, such as
+// 1062 "Duplicate entry '...' for key" and 1366 "Incorrect ... value: '...'".
+// The values aren't escaped, so each ends at the text which follows it.
+var errorValues = []*regexp.Regexp{
+	regexp.MustCompile(`(Duplicate entry ')(.*?)(' for key)`),
+	regexp.MustCompile(`((?i:incorrect) [\w ]+ value: ')(.*?)(' for column)`),
+	regexp.MustCompile(`(Truncated incorrect [\w ]+ value: ')(.*?)('(?:$|[\s;,]))`),
+}
+
+var logDataValues int32
+
+// setLogDataValues controls whether customer data values are written to the logs.
+func setLogDataValues(allow bool) {
+	var v int32
+	if allow {
+		v = 1
+	}
+	atomic.StoreInt32(&logDataValues, v)
+}
+
+// redactingFormatter masks credentials and, unless allowed, data values
+// before handing entries to the underlying formatter.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	allowData := atomic.LoadInt32(&logDataValues) == 1
+
+	clean := *entry
+	clean.Message = redactString(entry.Message, allowData)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+
+	for k, v := range entry.Data {
+		key := strings.ToLower(k)
+		switch {
+		case credentialFields[key]:
+			clean.Data[k] = redacted
+		case dataFields[key] && !allowData:
+			clean.Data[k] = redacted
+		default:
+			clean.Data[k] = redactValue(v, allowData)
+		}
+	}
+
+	return f.Formatter.Format(&clean)
+}
+
+func redactValue(v interface{}, allowData bool) interface{} {
+	switch value := v.(type) {
+	case string:
+		return redactString(value, allowData)
+	case error:
+		return redactString(value.Error(), allowData)
+	case fmt.Stringer:
+		return redactString(value.String(), allowData)
+	}
+	return v
+}
+
+func redactString(s string, allowData bool) string {
+	s = dsnPassword.ReplaceAllString(s, "$1:"+redacted+"@")
+	if !allowData {
+		for _, p := range errorValues {
+			s = p.ReplaceAllString(s, "${1}"+redacted+"${3}")
+		}
+	}
+	return s
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedaction(t *testing.T) {
+
+	Convey("Given a redacting formatter", t, func() {
+		formatter := &redactingFormatter{Formatter: &logrus.JSONFormatter{}}
+		format := func(fields logrus.Fields, message string) string {
+			entry := logrus.WithFields(fields)
+			entry.Message = message
+			out, err := formatter.Format(entry)
+			So(err, ShouldBeNil)
+			return string(out)
+		}
+
+		Convey("Then credentials should always be masked", func() {
+			setLogDataValues(true)
+			defer setLogDataValues(false)
+
+			out := format(logrus.Fields{
+				"password": "hunter2",
+				"error":    errors.New("couldn't connect to user:hunter2@tcp(db:3306)/naveego"),
+			}, "dsn is user:hunter2@tcp(db:3306)/naveego")
+			So(out, ShouldNotContainSubstring, "hunter2")
+			So(out, ShouldContainSubstring, "user:[REDACTED]@tcp(db:3306)")
+		})
+
+		Convey("Then data values should be masked by default", func() {
+			out := format(logrus.Fields{"params": []interface{}{"secret customer value"}, "sql": "INSERT"}, "Upserting record")
+			So(out, ShouldNotContainSubstring, "secret customer value")
+			So(out, ShouldContainSubstring, "INSERT")
+		})
+
+		Convey("Then data values should be logged when allowed", func() {
+			setLogDataValues(true)
+			defer setLogDataValues(false)
+
+			out := format(logrus.Fields{"params": []interface{}{"customer value"}}, "Upserting record")
+			So(out, ShouldContainSubstring, "customer value")
+		})
+
+		Convey("When errors from the server quote values", func() {
+			duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'jane@example.com' for key 'Email'"}
+			incorrect := &mysql.MySQLError{Number: 1366, Message: "Incorrect integer value: 'O'Brien, 42' for column `Age` at row 1"}
+			truncated := &mysql.MySQLError{Number: 1292, Message: "Truncated incorrect DOUBLE value: '555-0100'"}
+
+			Convey("Then the values should be masked by default", func() {
+				out := format(logrus.Fields{"error": duplicate}, "Error executing upsert: "+incorrect.Error())
+				So(out, ShouldNotContainSubstring, "jane@example.com")
+				So(out, ShouldNotContainSubstring, "Brien")
+				So(out, ShouldContainSubstring, "Duplicate entry '[REDACTED]' for key 'Email'")
+				So(out, ShouldContainSubstring, "Incorrect integer value: '[REDACTED]' for column `Age`")
+
+				out = format(logrus.Fields{"error": truncated}, "Error executing upsert")
+				So(out, ShouldNotContainSubstring, "555-0100")
+			})
+
+			Convey("Then the values should be logged when allowed", func() {
+				setLogDataValues(true)
+				defer setLogDataValues(false)
+
+				out := format(logrus.Fields{"error": duplicate}, "Error executing upsert")
+				So(out, ShouldContainSubstring, "jane@example.com")
+			})
+		})
+	})
+}
+
+func TestResolveSecret(t *testing.T) {
+
+	Convey("Should resolve secret references", t, func() {
+		os.Setenv("SUB_MARIADB_TEST_SECRET", "from-env")
+		defer os.Unsetenv("SUB_MARIADB_TEST_SECRET")
+
+		f, err := ioutil.TempFile("", "secret")
+		So(err, ShouldBeNil)
+		defer os.Remove(f.Name())
+		f.WriteString("from-file\n")
+		f.Close()
+
+		v, err := resolveSecret("env:SUB_MARIADB_TEST_SECRET")
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "from-env")
+
+		v, err = resolveSecret("file:" + f.Name())
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "from-file")
+
+		v, err = resolveSecret("plain")
+		So(v, ShouldEqual, "plain")
+
+		_, err = resolveSecret("env:SUB_MARIADB_TEST_MISSING")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should name the setting that could not be resolved", t, func() {
+		_, err := decodeSettings(map[string]interface{}{"password": "env:SUB_MARIADB_TEST_MISSING"})
+		So(err, ShouldNotBeNil)
+		So(strings.Contains(err.Error(), `"password"`), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxRetries   = 5
+	defaultRetryBackoff = 100 * time.Millisecond
+	retryBackoffMax     = 10 * time.Second
+)
+
+// MySQL error numbers for errors which go away if the statement is tried again.
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+	errServerGone      = 2006
+	errServerLost      = 2013
+)
+
+// isConnectionError reports whether err means the connection was lost.
+// The pool replaces lost connections, and the session connector initializes the new ones.
+func isConnectionError(err error) bool {
+	switch err {
+	case driver.ErrBadConn, mysql.ErrInvalidConn, sql.ErrConnDone:
+		return true
+	}
+	if myErr, ok := err.(*mysql.MySQLError); ok {
+		return myErr.Number == errServerGone || myErr.Number == errServerLost
+	}
+	return false
+}
+
+// isRetryable reports whether the statement that produced err can be tried again.
+func isRetryable(err error) bool {
+	if isConnectionError(err) {
+		return true
+	}
+	if myErr, ok := err.(*mysql.MySQLError); ok {
+		return myErr.Number == errDeadlock || myErr.Number == errLockWaitTimeout
+	}
+	return false
+}
+
+// retryPolicy retries idempotent operations that fail with transient errors,
+// using exponential backoff with full jitter.
+type retryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration
+
+	// noConnectionRetries is set for operations which mustn't be applied twice.
+	noConnectionRetries bool
+
+	log *logrus.Entry
+}
+
+func newRetryPolicy(s *settings) retryPolicy {
+	p := retryPolicy{
+		MaxRetries: s.MaxRetries,
+		Backoff:    s.RetryBackoff,
+	}
+	if p.Backoff == 0 {
+		p.Backoff = defaultRetryBackoff
+	}
+	return p
+}
+
+// withLog returns the policy logging its retries to log.
+func (p retryPolicy) withLog(log *logrus.Entry) retryPolicy {
+	p.log = log
+	return p
+}
+
+// withoutConnectionRetries returns the policy for an operation which isn't
+// idempotent, if skip is set. A lost connection doesn't tell whether the server
+// applied the operation before it was lost, so it isn't retried.
+func (p retryPolicy) withoutConnectionRetries(skip bool) retryPolicy {
+	p.noConnectionRetries = skip
+	return p
+}
+
+func (p retryPolicy) retryable(err error) bool {
+	if p.noConnectionRetries && isConnectionError(err) {
+		return false
+	}
+	return isRetryable(err)
+}
+
+// do runs op until it succeeds, fails with an error that isn't retryable,
+// or the retries are used up. It returns the number of retries made.
+func (p retryPolicy) do(op func() error) (retries int, err error) {
+	log := p.log
+	if log == nil {
+		log = logrus.NewEntry(logrus.StandardLogger())
+	}
+
+	delay := p.Backoff
+
+	for {
+		err = op()
+		if err == nil || !p.retryable(err) || retries >= p.MaxRetries {
+			return retries, err
+		}
+
+		log.WithError(err).WithField("retry", retries+1).Warn("Transient error, retrying")
+
+		time.Sleep(time.Duration(rand.Int63n(int64(delay) + 1)))
+
+		if delay *= 2; delay > retryBackoffMax {
+			delay = retryBackoffMax
+		}
+
+		retries++
+	}
+}
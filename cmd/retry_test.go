@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryPolicy(t *testing.T) {
+
+	Convey("Given a retry policy", t, func() {
+		policy := retryPolicy{
+			MaxRetries: 3,
+			Backoff:    time.Millisecond,
+		}
+
+		failing := func(errs ...error) func() error {
+			calls := 0
+			return func() error {
+				calls++
+				if calls <= len(errs) {
+					return errs[calls-1]
+				}
+				return nil
+			}
+		}
+
+		Convey("When a deadlock goes away", func() {
+			retries, err := policy.do(failing(&mysql.MySQLError{Number: errDeadlock}))
+			So(err, ShouldBeNil)
+			So(retries, ShouldEqual, 1)
+		})
+
+		Convey("When the connection is lost", func() {
+			retries, err := policy.do(failing(mysql.ErrInvalidConn, &mysql.MySQLError{Number: errServerGone}))
+			So(err, ShouldBeNil)
+			So(retries, ShouldEqual, 2)
+		})
+
+		Convey("When the connection is lost during an operation which isn't idempotent", func() {
+			calls := 0
+			retries, err := policy.withoutConnectionRetries(true).do(func() error {
+				calls++
+				return mysql.ErrInvalidConn
+			})
+
+			Convey("Then it should not be replayed", nil)
+			So(err, ShouldEqual, mysql.ErrInvalidConn)
+			So(retries, ShouldEqual, 0)
+			So(calls, ShouldEqual, 1)
+
+			Convey("Then deadlocks, which roll the statement back, should still be retried", nil)
+			retries, err = policy.withoutConnectionRetries(true).do(failing(&mysql.MySQLError{Number: errDeadlock}))
+			So(err, ShouldBeNil)
+			So(retries, ShouldEqual, 1)
+		})
+
+		Convey("When the error is not transient", func() {
+			dupErr := &mysql.MySQLError{Number: 1062}
+			retries, err := policy.do(failing(dupErr))
+			So(err, ShouldEqual, dupErr)
+			So(retries, ShouldEqual, 0)
+		})
+
+		Convey("When the retries are used up", func() {
+			lockErr := &mysql.MySQLError{Number: errLockWaitTimeout}
+			retries, err := policy.do(failing(lockErr, lockErr, lockErr, lockErr, lockErr))
+			So(err, ShouldEqual, lockErr)
+			So(retries, ShouldEqual, 3)
+		})
+
+		Convey("Then other errors should not be retryable", func() {
+			So(isRetryable(errors.New("boom")), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given retry settings", t, func() {
+		Convey("When they're missing", func() {
+			s, err := decodeSettings(map[string]interface{}{})
+			So(err, ShouldBeNil)
+
+			Convey("Then the defaults should be used", nil)
+			So(s.MaxRetries, ShouldEqual, defaultMaxRetries)
+			So(s.ConnectRetries, ShouldEqual, defaultConnectRetries)
+		})
+
+		Convey("When they're 0", func() {
+			s, err := decodeSettings(map[string]interface{}{"maxRetries": 0, "connectRetries": 0})
+			So(err, ShouldBeNil)
+			So(s.ConnectRetries, ShouldEqual, 0)
+
+			Convey("Then writes should not be retried", nil)
+			calls := 0
+			retries, err := newRetryPolicy(s).do(func() error {
+				calls++
+				return &mysql.MySQLError{Number: errDeadlock}
+			})
+			So(err, ShouldNotBeNil)
+			So(retries, ShouldEqual, 0)
+			So(calls, ShouldEqual, 1)
+		})
+	})
+}
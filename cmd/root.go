@@ -15,54 +15,83 @@
 package cmd
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/naveego/navigator-go/subscribers/server"
 	"github.com/naveego/pipeline-subscribers/shapeutils"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-var verbose *bool
+var (
+	metricsAddr        string
+	healthAddr         string
+	healthPingInterval time.Duration
+	healthMaxWriteAge  time.Duration
+	shutdownTimeout    time.Duration
+)
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "mariadb [listen address]",
 	Args:  cobra.ExactArgs(1),
 	Short: "A subscriber that sends all data to MariaDB",
-	Long: `Settings should contain a DataSourceName property with a value 
-corresponding to the standard MariaDB/MySQL connection string: "user:password@address:port/database".
+	Long: `Settings should contain the host, port, user, password and database to connect to,
+optionally with a TLS mode and extra driver parameters ("key=value&key=value").
+
+For backward compatibility a DataSourceName property with a value corresponding to the
+standard MariaDB/MySQL connection string ("user:password@tcp(address:port)/database")
+can be used instead.
 
 User must have CREATE and ALTER permissions.`,
 
-	Run: func(cmd *cobra.Command, args []string) {
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return configureLogging()
+	},
 
-		logrus.SetOutput(os.Stdout)
+	RunE: func(cmd *cobra.Command, args []string) error {
 
 		addr := args[0]
 
-		if *verbose {
-			logrus.SetLevel(logrus.DebugLevel)
+		subscriber := &mariaSubscriber{
+			knownShapes: newLockedShapeCache(shapeutils.NewShapeCache()),
 		}
 
-		subscriber := &mariaSubscriber{
-			knownShapes: shapeutils.NewShapeCache(),
+		admin := adminServers{}
+		admin.handle(metricsAddr, "/metrics", metrics.handler())
+		if healthAddr != "" {
+			health := newHealthChecker(subscriber, healthPingInterval, healthMaxWriteAge)
+			go health.run(make(chan struct{}))
+			admin.handle(healthAddr, "/healthz", health.handler(health.liveness))
+			admin.handle(healthAddr, "/readyz", health.handler(health.readiness))
 		}
+		admin.start()
 
 		srv := server.NewSubscriberServer(addr, subscriber)
 
+		listenErr := make(chan error, 1)
 		go func() {
-			err := srv.ListenAndServe()
-			if err != nil {
-				panic(err)
-			}
+			listenErr <- srv.ListenAndServe()
 		}()
 
-		<-awaitShutdown()
+		signals := awaitShutdown()
+
+		select {
+		case err := <-listenErr:
+			logrus.WithError(err).Error("Listener stopped")
+			if shutdownErr := shutdownSubscriber(subscriber, shutdownTimeout, signals); shutdownErr != nil {
+				logrus.WithError(shutdownErr).Error("Shutdown failed")
+			}
+			return fmt.Errorf("listener stopped: %v", err)
+		case sig := <-signals:
+			logrus.WithField("signal", sig).Info("Received signal")
+			stopListening(srv)
+			return shutdownSubscriber(subscriber, shutdownTimeout, signals)
+		}
 	},
 }
 
@@ -77,28 +106,31 @@ func Execute() {
 
 func init() {
 
-	verbose = flag.Bool("v", false, "enable verbose logging")
+	flags := RootCmd.PersistentFlags()
+	flags.BoolVarP(&verbose, "verbose", "v", false, "enable verbose logging (same as --log-level=debug)")
+	flags.StringVar(&logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flags.StringVar(&logFormat, "log-format", "text", "log format: json or text")
+	flags.StringVar(&logFile, "log-file", "", "write logs to this file instead of stdout, rotating it by size")
+	flags.IntVar(&logFileMaxSize, "log-file-max-size", 100, "size in megabytes at which the log file is rotated")
+	flags.IntVar(&logFileMaxBackups, "log-file-max-backups", 5, "number of rotated log files to keep")
+
+	RootCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics at /metrics on this address, for example :9102")
+	RootCmd.Flags().StringVar(&healthAddr, "health-addr", "", "serve /healthz and /readyz on this address; it can be the same as --metrics-addr")
+	RootCmd.Flags().DurationVar(&healthPingInterval, "health-ping-interval", defaultPingInterval, "how often the health checks ping the database")
+	RootCmd.Flags().DurationVar(&healthMaxWriteAge, "health-max-write-age", 0, "report not ready when the last successful write is older than this; 0 turns the check off")
+	RootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "how long to wait on SIGINT or SIGTERM for writes to finish; 0 waits as long as it takes")
 }
 
-func awaitShutdown() <-chan bool {
-	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
+// awaitShutdown returns a channel which receives SIGINT and SIGTERM. The first
+// starts the shutdown; a second stops waiting for it.
+func awaitShutdown() <-chan os.Signal {
+	sigs := make(chan os.Signal, 2)
 
 	// `signal.Notify` registers the given channel to
 	// receive notifications of the specified signals.
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	// This goroutine executes a blocking receive for
-	// signals. When it gets one it'll print it out
-	// and then notify the program that it can finish.
-	go func() {
-		sig := <-sigs
-		fmt.Println()
-		fmt.Println(sig)
-		done <- true
-	}()
-
 	fmt.Println("CTRL-C to quit")
 
-	return done
+	return sigs
 }
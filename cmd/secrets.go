@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// resolveSecret returns the value a secret setting refers to. Values of the form
+// "env:VAR" are read from the environment variable VAR, and values of the form
+// "file:/path" are read from the file at /path. Other values are returned as is.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return resolved, nil
+
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return value, nil
+}
+
+// resolveSecrets replaces secret references in the settings with the values they refer to.
+func (s *settings) resolveSecrets() error {
+	secrets := []struct {
+		field string
+		value *string
+	}{
+		{"password", &s.Password},
+		{"dataSourceName", &s.DataSourceName},
+		{"tlsKey", &s.TLSKey},
+	}
+
+	for _, secret := range secrets {
+		resolved, err := resolveSecret(*secret.value)
+		if err != nil {
+			return settingsError{secret.field, err.Error()}
+		}
+		*secret.value = resolved
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// serverVersion is a parsed VERSION() string, like "10.3.8-MariaDB-log" or "8.0.21".
+type serverVersion struct {
+	Raw     string
+	MariaDB bool
+	Major   int
+	Minor   int
+	Patch   int
+}
+
+func parseServerVersion(raw string) serverVersion {
+	v := serverVersion{
+		Raw:     raw,
+		MariaDB: strings.Contains(strings.ToLower(raw), "mariadb"),
+	}
+
+	// Replication-compatible MariaDB servers prefix the real version with "5.5.5-".
+	number := strings.TrimPrefix(raw, "5.5.5-")
+	if i := strings.IndexAny(number, "-+ "); i >= 0 {
+		number = number[:i]
+	}
+
+	parts := strings.SplitN(number, ".", 3)
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		*nums[i] = n
+	}
+
+	return v
+}
+
+// atLeast reports whether the version is major.minor.patch or later.
+func (v serverVersion) atLeast(major, minor, patch int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	if v.Minor != minor {
+		return v.Minor > minor
+	}
+	return v.Patch >= patch
+}
+
+func (v serverVersion) String() string {
+	product := "MySQL"
+	if v.MariaDB {
+		product = "MariaDB"
+	}
+	return fmt.Sprintf("%s %d.%d.%d", product, v.Major, v.Minor, v.Patch)
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sessionConnector runs the session statements on every new connection,
+// so that they apply to the whole pool and survive reconnects.
+type sessionConnector struct {
+	driver.Connector
+	statements []string
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok && len(c.statements) > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("driver connection %T can't execute session statements", conn)
+	}
+
+	for _, stmt := range c.statements {
+		if _, err = execer.ExecContext(ctx, stmt, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("couldn't initialize session (%s): %s", stmt, err)
+		}
+	}
+
+	return conn, nil
+}
+
+var charsetName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (s *settings) validateSession() error {
+	if s.SessionNames != "" && !charsetName.MatchString(s.SessionNames) {
+		return settingsError{"sessionNames", fmt.Sprintf("%q is not a character set name", s.SessionNames)}
+	}
+	if s.SessionLockWaitTimeout < 0 {
+		return settingsError{"sessionLockWaitTimeout", "must not be negative"}
+	}
+	return nil
+}
+
+// sessionStatements returns the statements run on every new connection.
+func (s *settings) sessionStatements() []string {
+	var statements []string
+
+	if s.SessionNames != "" {
+		statements = append(statements, fmt.Sprintf("SET NAMES %s", s.SessionNames))
+	}
+	if s.SessionSQLMode != "" {
+		statements = append(statements, fmt.Sprintf("SET @@session.sql_mode = %s", quoteString(s.SessionSQLMode)))
+	}
+	if s.SessionTimeZone != "" {
+		statements = append(statements, fmt.Sprintf("SET @@session.time_zone = %s", quoteString(s.SessionTimeZone)))
+	}
+	if s.SessionLockWaitTimeout > 0 {
+		statements = append(statements, fmt.Sprintf("SET @@session.innodb_lock_wait_timeout = %d", s.SessionLockWaitTimeout))
+	}
+
+	// Turning the checks off improves the performance of inserts.
+	statements = append(statements,
+		fmt.Sprintf("SET @@session.unique_checks = %d", boolToInt(s.SessionUniqueChecks)),
+		fmt.Sprintf("SET @@session.foreign_key_checks = %d", boolToInt(s.SessionForeignKeyChecks)),
+	)
+
+	return statements
+}
+
+// quoteString renders s as a SQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(s) + "'"
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mitchellh/mapstructure"
+)
+
+const defaultPort = 3306
+
+// settings are the connection settings sent by Navigator.
+// Either the structured fields or a raw DataSourceName can be used;
+// if DataSourceName is present it takes precedence.
+// Password, DataSourceName and TLSKey may be given as "env:VAR" or "file:/path" references.
+//
+// The tags describe each setting in the config schema of manifest.json, which
+// the manifest command generates: its name, label, secret, enum, default and help.
+// The type comes from the field's Go type unless it's tagged.
+type settings struct {
+	Host     string `mapstructure:"host" label:"Host"`
+	Port     int    `mapstructure:"port" label:"Port" default:"3306"`
+	User     string `mapstructure:"user" label:"User"`
+	Password string `mapstructure:"password" label:"Password (or env:VAR / file:/path)" secret:"true"`
+	Database string `mapstructure:"database" label:"Database"`
+
+	// TLSMode is one of "", "false", "true", "skip-verify" or "preferred",
+	// matching the tls parameter of the MySQL driver.
+	TLSMode string `mapstructure:"tlsMode" label:"TLS Mode" enum:"false,true,skip-verify,preferred"`
+
+	// TLSCA, TLSCert and TLSKey are either paths to PEM files or PEM content.
+	// When any of them is set a custom TLS configuration is registered for the connection.
+	TLSCA         string `mapstructure:"tlsCA" label:"TLS CA Bundle (path or PEM)"`
+	TLSCert       string `mapstructure:"tlsCert" label:"TLS Client Certificate (path or PEM)"`
+	TLSKey        string `mapstructure:"tlsKey" label:"TLS Client Key (path or PEM)" secret:"true"`
+	TLSServerName string `mapstructure:"tlsServerName" label:"TLS Server Name"`
+	TLSSkipVerify bool   `mapstructure:"tlsSkipVerify" label:"Skip TLS Verification"`
+
+	// Params are extra driver parameters in query string form, e.g. "charset=utf8mb4&parseTime=true".
+	Params string `mapstructure:"params" label:"Extra Parameters" help:"Driver parameters as key=value&key=value"`
+
+	// Connection pool settings. Durations are given as strings like "30s" or "5m".
+	MaxOpenConns    int           `mapstructure:"maxOpenConns" label:"Max Open Connections"`
+	MaxIdleConns    int           `mapstructure:"maxIdleConns" label:"Max Idle Connections"`
+	ConnMaxLifetime time.Duration `mapstructure:"connMaxLifetime" label:"Connection Lifetime (e.g. 5m)"`
+	ConnectTimeout  time.Duration `mapstructure:"connectTimeout" label:"Connect Timeout (e.g. 10s)" default:"10s"`
+	ConnectRetries  int           `mapstructure:"connectRetries" label:"Connect Retries" default:"3"`
+
+	// MaxRetries is how many times a write failing with a transient error
+	// (deadlock, lock wait timeout, lost connection) is retried; 0 turns retries off.
+	MaxRetries   int           `mapstructure:"maxRetries" label:"Max Retries for Transient Errors" default:"5"`
+	RetryBackoff time.Duration `mapstructure:"retryBackoff" label:"Retry Backoff (e.g. 100ms)" default:"100ms"`
+
+	// LogDataValues allows customer data values to be written to the logs.
+	// Credentials are always masked.
+	LogDataValues bool `mapstructure:"logDataValues" label:"Log Data Values" default:"false" help:"Credentials are always masked"`
+
+	// TestWrites makes TestConnection create, insert into and drop a scratch table.
+	TestWrites bool `mapstructure:"testWrites" label:"Test Connection Writes a Scratch Table" default:"false"`
+
+	// Session settings are applied to every new connection in the pool.
+	// Unique and foreign key checks are off unless turned on here.
+	SessionSQLMode          string `mapstructure:"sessionSQLMode" label:"Session sql_mode"`
+	SessionTimeZone         string `mapstructure:"sessionTimeZone" label:"Session time_zone"`
+	SessionNames            string `mapstructure:"sessionNames" label:"Session Character Set (SET NAMES)"`
+	SessionLockWaitTimeout  int    `mapstructure:"sessionLockWaitTimeout" label:"Session innodb_lock_wait_timeout (seconds)"`
+	SessionUniqueChecks     bool   `mapstructure:"sessionUniqueChecks" label:"Session Unique Checks" default:"false"`
+	SessionForeignKeyChecks bool   `mapstructure:"sessionForeignKeyChecks" label:"Session Foreign Key Checks" default:"false"`
+
+	// Date handling. DateLayouts are Go time layouts tried before the defaults (RFC 3339,
+	// with or without fractional seconds, and date only). Dates sent as numbers are Unix
+	// epoch times in DateEpochUnit: "auto", "s", "ms" or "us". Values are stored in
+	// DateTimeZone, UTC by default, using DateColumnType or the type in DateColumns
+	// for the property: DATETIME, DATETIME(6), DATE or TIME.
+	DateLayouts    []string          `mapstructure:"dateLayouts" label:"Date Layouts (Go time layouts)" help:"Tried before RFC 3339 and 2006-01-02"`
+	DateTimeZone   string            `mapstructure:"dateTimeZone" label:"Date Time Zone" default:"UTC"`
+	DateEpochUnit  string            `mapstructure:"dateEpochUnit" label:"Epoch Date Unit" enum:"auto,s,ms,us" default:"auto"`
+	DateColumnType string            `mapstructure:"dateColumnType" label:"Date Column Type" enum:"DATETIME,DATETIME(6),DATE,TIME" default:"DATETIME"`
+	DateColumns    map[string]string `mapstructure:"dateColumns" label:"Date Column Types by Property"`
+
+	// InvalidValuePolicy decides what happens to values which can't be converted
+	// to their column's type: "error" (the default), "deadletter" or "null".
+	InvalidValuePolicy string `mapstructure:"invalidValuePolicy" label:"Invalid Value Policy" enum:"error,deadletter,null" default:"error"`
+
+	// ValueCoercion is how strictly values are converted to their column's type: "lenient"
+	// (the default) converts numeric strings, boolean spellings like "yes", and numbers for
+	// text columns; "strict" only accepts values of the column's kind; "off" leaves it to the server.
+	ValueCoercion string `mapstructure:"valueCoercion" label:"Value Conversion" enum:"lenient,strict,off" default:"lenient" help:"Values which can't be converted are handled by the invalid value policy"`
+
+	// ParallelWrites writes each shape on its own workers in the background.
+	// WriterShards spreads a shape's writes over more workers by key, and
+	// WriterQueueSize is how many writes can wait per worker before ReceiveDataPoint blocks.
+	// Workers share the connection pool, so if MaxOpenConns is set it must leave
+	// reservedConns free besides WriterShards.
+	ParallelWrites  bool `mapstructure:"parallelWrites" label:"Parallel Writes" default:"false"`
+	WriterShards    int  `mapstructure:"writerShards" label:"Writers per Shape" default:"1"`
+	WriterQueueSize int  `mapstructure:"writerQueueSize" label:"Writer Queue Size" default:"1000"`
+
+	// SparseUpserts only writes the properties present in each data point, so the
+	// properties a partial update leaves out keep their stored values instead of
+	// being set to NULL.
+	SparseUpserts bool `mapstructure:"sparseUpserts" label:"Only Write Properties Present in Each Data Point" default:"false" help:"Missing properties keep their stored values; properties sent as null are set to NULL"`
+
+	// MergeRules decide how an update combines each property with the stored value:
+	// overwrite (the default), coalesce, keepfirst, max, min, sum, append (text)
+	// or appendarray (JSON arrays). Keys are property names, or shape/property.
+	// Writes using sum, append or appendarray aren't retried after a lost connection,
+	// as they may already have been applied.
+	MergeRules map[string]string `mapstructure:"mergeRules" label:"Merge Rules by Property" help:"overwrite, coalesce, keepfirst, max, min, sum, append or appendarray, by property or shape/property"`
+
+	// KeylessShapes is how the table of a shape without keys is keyed: "none" (the
+	// default) leaves it without a primary key, so re-runs duplicate its records;
+	// "autoincrement" and "sequence" add a naveegoId surrogate key; "hash" keys records
+	// by a hash of their properties, so records sent again aren't duplicated.
+	// ShapeKeys declares the keys of shapes by name, and takes precedence.
+	KeylessShapes string              `mapstructure:"keylessShapes" label:"Key for Shapes Without Keys" enum:"none,autoincrement,sequence,hash" default:"none" help:"sequence needs MariaDB 10.3; hash deduplicates records sent again"`
+	ShapeKeys     map[string][]string `mapstructure:"shapeKeys" label:"Keys by Shape" help:"Property names by shape name, for shapes sent without keys"`
+
+	// OutOfOrderGuard only lets a write update a record if its VersionProperty
+	// (naveegoPublishedAt by default) is at least the stored one, so a replayed or
+	// delayed older version can't overwrite a newer one. A write without a version
+	// is applied, keeping the stored version.
+	OutOfOrderGuard bool   `mapstructure:"outOfOrderGuard" label:"Don't Overwrite Newer Versions of Records" default:"false"`
+	VersionProperty string `mapstructure:"versionProperty" label:"Version Property for the Out of Order Guard" default:"naveegoPublishedAt"`
+
+	// Checkpoints keeps the highest publishedAt and the count committed for each
+	// publisher and shape in naveego_checkpoints, in the same transaction as the data.
+	// They need the writes for a shape to be in order, so only one writer per shape.
+	Checkpoints bool `mapstructure:"checkpoints" label:"Keep Checkpoints per Publisher and Shape" default:"false"`
+
+	// DeadLetterBudget is how many data points can be dead lettered before
+	// the subscriber reports it isn't ready. 0 means no limit.
+	DeadLetterBudget int64 `mapstructure:"deadLetterBudget" label:"Dead Letters Allowed Before Not Ready (0 for no limit)" type:"integer" default:"0"`
+
+	// RunID is the correlation ID added to every log line of the run.
+	// A random one is used if it's not set.
+	RunID string `mapstructure:"runId" label:"Run Correlation ID for Logs"`
+
+	DataSourceName string `mapstructure:"dataSourceName" label:"DataSourceName (overrides the settings above)" secret:"true"`
+}
+
+// settingsError describes a problem with a single setting.
+type settingsError struct {
+	Field   string
+	Message string
+}
+
+func (e settingsError) Error() string {
+	return fmt.Sprintf("invalid setting %q: %s", e.Field, e.Message)
+}
+
+func decodeSettings(settingsMap map[string]interface{}) (*settings, error) {
+	// No retries is a setting of its own, so these defaults are applied when the
+	// settings are missing rather than when they're zero.
+	s := &settings{ConnectRetries: defaultConnectRetries, MaxRetries: defaultMaxRetries}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		Result:           s,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.Decode(settingsMap)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode settings: %s", err)
+	}
+
+	err = s.resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *settings) validate() error {
+	if err := s.validatePool(); err != nil {
+		return err
+	}
+	if err := s.validateSession(); err != nil {
+		return err
+	}
+
+	if s.DataSourceName != "" {
+		if _, err := mysql.ParseDSN(s.DataSourceName); err != nil {
+			return settingsError{"dataSourceName", err.Error()}
+		}
+		return s.validateTLS()
+	}
+
+	if s.Host == "" {
+		return settingsError{"host", "a host (or a dataSourceName) is required"}
+	}
+	if strings.ContainsAny(s.Host, "/@?") {
+		return settingsError{"host", "must be a host name or IP address, not a connection string"}
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return settingsError{"port", fmt.Sprintf("%d is not a valid port", s.Port)}
+	}
+	if s.User == "" {
+		return settingsError{"user", "a user is required"}
+	}
+	if s.Database == "" {
+		return settingsError{"database", "a database is required"}
+	}
+
+	switch strings.ToLower(s.TLSMode) {
+	case "", "false", "true", "skip-verify", "preferred":
+	default:
+		return settingsError{"tlsMode", fmt.Sprintf("%q is not one of false, true, skip-verify or preferred", s.TLSMode)}
+	}
+
+	if _, err := url.ParseQuery(s.Params); err != nil {
+		return settingsError{"params", err.Error()}
+	}
+
+	return s.validateTLS()
+}
+
+func (s *settings) validatePool() error {
+	if s.MaxOpenConns < 0 {
+		return settingsError{"maxOpenConns", "must not be negative"}
+	}
+	if s.MaxIdleConns < 0 {
+		return settingsError{"maxIdleConns", "must not be negative"}
+	}
+	if s.ConnMaxLifetime < 0 {
+		return settingsError{"connMaxLifetime", "must not be negative"}
+	}
+	if s.ConnectTimeout < 0 {
+		return settingsError{"connectTimeout", "must not be negative"}
+	}
+	if s.ConnectRetries < 0 {
+		return settingsError{"connectRetries", "must not be negative"}
+	}
+	if s.MaxRetries < 0 {
+		return settingsError{"maxRetries", "must not be negative"}
+	}
+	if s.RetryBackoff < 0 {
+		return settingsError{"retryBackoff", "must not be negative"}
+	}
+	if s.WriterShards < 0 {
+		return settingsError{"writerShards", "must not be negative"}
+	}
+	if s.WriterQueueSize < 0 {
+		return settingsError{"writerQueueSize", "must not be negative"}
+	}
+	if !s.ParallelWrites {
+		return nil
+	}
+
+	shards := s.WriterShards
+	if shards == 0 {
+		shards = defaultWriterShards
+	}
+	if need := shards + reservedConns; s.MaxOpenConns > 0 && s.MaxOpenConns < need {
+		return settingsError{"writerShards", fmt.Sprintf("%d writers per shape need a maxOpenConns of at least %d", shards, need)}
+	}
+	// A shape's shards commit out of order, so its highest publishedAt isn't a safe place to resume from.
+	if s.Checkpoints && shards > 1 {
+		return settingsError{"checkpoints", "can't be kept with more than one writer per shape"}
+	}
+	return nil
+}
+
+func (s *settings) validateTLS() error {
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		if s.TLSCert == "" {
+			return settingsError{"tlsCert", "a client certificate is required when a client key is set"}
+		}
+		return settingsError{"tlsKey", "a client key is required when a client certificate is set"}
+	}
+	return nil
+}
+
+// dsn validates the settings and returns the data source name to connect with.
+func (s *settings) dsn() (string, error) {
+	cfg, err := s.config()
+	if err != nil {
+		return "", err
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// config validates the settings and returns the driver configuration to connect with.
+func (s *settings) config() (*mysql.Config, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	if s.DataSourceName != "" {
+		cfg, err := mysql.ParseDSN(s.DataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		if s.ConnectTimeout > 0 {
+			cfg.Timeout = s.ConnectTimeout
+		}
+		return cfg, nil
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = defaultPort
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = s.User
+	cfg.Passwd = s.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(s.Host, strconv.Itoa(port))
+	cfg.DBName = s.Database
+	cfg.TLSConfig = strings.ToLower(s.TLSMode)
+	cfg.Timeout = s.ConnectTimeout
+
+	params, _ := url.ParseQuery(s.Params)
+	if len(params) == 0 {
+		return cfg, nil
+	}
+
+	// The driver sends whatever is left in Params as SET statements on every new
+	// connection, so driver parameters like parseTime and loc have to be parsed into
+	// their own fields, the way they would be from a DSN.
+	cfg.Params = map[string]string{}
+	for k := range params {
+		cfg.Params[k] = params.Get(k)
+	}
+	parsed, err := mysql.ParseDSN(cfg.FormatDSN())
+	if err != nil {
+		return nil, settingsError{"params", err.Error()}
+	}
+	return parsed, nil
+}
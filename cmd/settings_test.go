@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSettings(t *testing.T) {
+
+	Convey("Given structured settings", t, func() {
+
+		settingsMap := map[string]interface{}{
+			"host":     "db.example.com",
+			"port":     3307.0,
+			"user":     "bucket",
+			"password": "bucket123!",
+			"database": "naveego",
+			"tlsMode":  "skip-verify",
+			"params":   "charset=utf8mb4",
+		}
+
+		Convey("When the settings are valid", func() {
+			s, err := decodeSettings(settingsMap)
+			So(err, ShouldBeNil)
+
+			Convey("Then the DSN should be built from them", nil)
+			dsn, err := s.dsn()
+			So(err, ShouldBeNil)
+			So(dsn, ShouldStartWith, "bucket:bucket123!@tcp(db.example.com:3307)/naveego?")
+			So(dsn, ShouldContainSubstring, "tls=skip-verify")
+			So(dsn, ShouldContainSubstring, "charset=utf8mb4")
+		})
+
+		Convey("When the params include driver parameters", func() {
+			settingsMap["params"] = "charset=utf8mb4&parseTime=true&loc=UTC&sql_mode=TRADITIONAL"
+			s, _ := decodeSettings(settingsMap)
+			cfg, err := s.config()
+			So(err, ShouldBeNil)
+
+			Convey("Then they should set the driver's options", nil)
+			So(cfg.ParseTime, ShouldBeTrue)
+			So(cfg.Loc, ShouldEqual, time.UTC)
+
+			Convey("Then only session variables should be sent with SET", nil)
+			So(cfg.Params, ShouldNotContainKey, "parseTime")
+			So(cfg.Params, ShouldNotContainKey, "loc")
+			So(cfg.Params, ShouldContainKey, "sql_mode")
+		})
+
+		Convey("When the port is missing", func() {
+			delete(settingsMap, "port")
+			s, _ := decodeSettings(settingsMap)
+			dsn, err := s.dsn()
+			So(err, ShouldBeNil)
+			So(dsn, ShouldStartWith, "bucket:bucket123!@tcp(db.example.com:3306)/naveego")
+		})
+
+		Convey("When a field is wrong", func() {
+			settingsMap["tlsMode"] = "sometimes"
+			s, _ := decodeSettings(settingsMap)
+			_, err := s.dsn()
+
+			Convey("Then the error should name the field", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `"tlsMode"`)
+		})
+
+		Convey("When a required field is missing", func() {
+			delete(settingsMap, "database")
+			s, _ := decodeSettings(settingsMap)
+			_, err := s.dsn()
+			So(err, ShouldResemble, settingsError{"database", "a database is required"})
+		})
+	})
+
+	Convey("Given TLS settings", t, func() {
+		s := &settings{Host: "db", User: "u", Database: "d", TLSMode: "true"}
+
+		Convey("When a client certificate is set without a key", func() {
+			s.TLSCert = "client.pem"
+			Convey("Then validation should name the missing key", nil)
+			So(s.validate(), ShouldResemble, settingsError{"tlsKey", "a client key is required when a client certificate is set"})
+		})
+
+		Convey("When the CA bundle has no certificates", func() {
+			s.TLSCA = "-----BEGIN CERTIFICATE-----\nnot a cert\n-----END CERTIFICATE-----"
+			_, err := s.buildTLSConfig()
+			So(err, ShouldResemble, settingsError{"tlsCA", "no certificates found in CA bundle"})
+		})
+
+		Convey("When skip-verify is requested", func() {
+			s.TLSSkipVerify = true
+			cfg, _ := s.config()
+			name, err := s.registerTLS(cfg)
+			So(err, ShouldBeNil)
+			So(name, ShouldStartWith, "sub-mariadb-")
+			So(cfg.TLSConfig, ShouldEqual, name)
+		})
+	})
+
+	Convey("Given a raw DataSourceName", t, func() {
+		s, err := decodeSettings(map[string]interface{}{
+			"DataSourceName": "user:password@tcp(localhost:3306)/db",
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Then it should be used as is", nil)
+		dsn, err := s.dsn()
+		So(err, ShouldBeNil)
+		So(dsn, ShouldEqual, "user:password@tcp(localhost:3306)/db")
+	})
+
+	Convey("Given parallel writes with a connection limit", t, func() {
+		s := &settings{DataSourceName: "user:password@tcp(localhost:3306)/db", ParallelWrites: true, MaxOpenConns: 4}
+
+		Convey("Then the writers for a shape should leave the reserved connections free", func() {
+			s.WriterShards = 2
+			So(s.validate(), ShouldBeNil)
+			s.WriterShards = 3
+			So(s.validate(), ShouldResemble, settingsError{"writerShards", "3 writers per shape need a maxOpenConns of at least 5"})
+		})
+
+		Convey("Then a single writer should still need the reserved connections", func() {
+			s.MaxOpenConns = 2
+			So(s.validate(), ShouldResemble, settingsError{"writerShards", "1 writers per shape need a maxOpenConns of at least 3"})
+		})
+	})
+}
+
+func TestSessionStatements(t *testing.T) {
+
+	Convey("Given session settings", t, func() {
+		s := &settings{
+			SessionNames:           "utf8mb4",
+			SessionSQLMode:         "STRICT_ALL_TABLES",
+			SessionTimeZone:        "+00:00",
+			SessionLockWaitTimeout: 10,
+		}
+
+		Convey("Then every setting should become a statement", func() {
+			So(s.sessionStatements(), ShouldResemble, []string{
+				"SET NAMES utf8mb4",
+				"SET @@session.sql_mode = 'STRICT_ALL_TABLES'",
+				"SET @@session.time_zone = '+00:00'",
+				"SET @@session.innodb_lock_wait_timeout = 10",
+				"SET @@session.unique_checks = 0",
+				"SET @@session.foreign_key_checks = 0",
+			})
+		})
+
+		Convey("Then values should be quoted", func() {
+			s.SessionTimeZone = "x'; DROP TABLE y; --"
+			So(s.sessionStatements()[2], ShouldEqual, "SET @@session.time_zone = 'x''; DROP TABLE y; --'")
+		})
+
+		Convey("Then character set names should be validated", func() {
+			s.SessionNames = "utf8; DROP"
+			So(s.validateSession(), ShouldResemble, settingsError{"sessionNames", `"utf8; DROP" is not a character set name`})
+		})
+	})
+}
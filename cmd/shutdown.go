@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var errShuttingDown = errors.New("the subscriber is shutting down")
+
+func (h *mariaSubscriber) isClosing() bool {
+	return atomic.LoadInt32(&h.closing) == 1
+}
+
+// shutdown rejects new requests, waits for the ones in flight, finishes the
+// queued writes, which have already been acknowledged, and ends the run.
+func (h *mariaSubscriber) shutdown() (string, error) {
+	atomic.StoreInt32(&h.closing, 1)
+
+	// Requests in flight hold the read lock.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	response, err := h.dispose()
+	return response.Message, err
+}
+
+// stopListening closes the protocol server's listener, when the server can be
+// closed, so new requests don't reach a subscriber which is shutting down. Any
+// which still do are rejected by the subscriber.
+func stopListening(srv interface{}) {
+	c, ok := srv.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		logrus.WithError(err).Warn("Couldn't close the listener")
+	}
+}
+
+// shutdownSubscriber shuts sub down, giving up after timeout, or when
+// another signal arrives. A timeout of 0 waits as long as it takes.
+func shutdownSubscriber(sub *mariaSubscriber, timeout time.Duration, signals <-chan os.Signal) error {
+	log := logrus.WithField("timeout", timeout)
+	log.Info("Shutting down")
+
+	done := make(chan error, 1)
+	go func() {
+		message, err := sub.shutdown()
+		log.WithField("message", message).Info("Shut down")
+		done <- err
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-deadline:
+		return fmt.Errorf("shutdown didn't finish within %s; uncommitted data may be lost", timeout)
+	case sig := <-signals:
+		return fmt.Errorf("shutdown interrupted by %s; uncommitted data may be lost", sig)
+	}
+}
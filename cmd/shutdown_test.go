@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeListener struct{ closed bool }
+
+func (l *fakeListener) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+
+	Convey("Given a server which can be closed", t, func() {
+		l := &fakeListener{}
+
+		Convey("Then stopping it should close its listener", func() {
+			stopListening(l)
+			So(l.closed, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an initialized subscriber with a run in the ledger", t, func() {
+		s := &settings{ParallelWrites: true}
+		sub, fake := newTestSubscriber(s)
+		sub.startRun("run-1")
+		sub.writers = newWriterPool(sub.db, s, sub.retry, sub.summary)
+
+		request := func(id int) protocol.ReceiveShapeRequest {
+			return protocol.ReceiveShapeRequest{
+				DataPoint: pipeline.DataPoint{
+					Source: "Test",
+					Entity: "Products",
+					Shape: pipeline.Shape{
+						KeyNames:   []string{"ID"},
+						Properties: []string{"ID:integer", "Name:string"},
+					},
+					Data: map[string]interface{}{"ID": id, "Name": "Product"},
+				},
+			}
+		}
+
+		upserts := func() int {
+			n := 0
+			for _, e := range fake.executed() {
+				if strings.HasPrefix(e.query, "INSERT INTO `Test.Products`") {
+					n++
+				}
+			}
+			return n
+		}
+
+		Convey("When it's shut down while acknowledged writes are still queued", func() {
+			// Hold the writers until the shutdown has started.
+			gate := make(chan struct{})
+			fake.fail = func(query string, args []driver.Value) error {
+				if strings.HasPrefix(query, "INSERT INTO `Test.Products`") {
+					<-gate
+				}
+				return nil
+			}
+
+			for i := 0; i < 3; i++ {
+				response, err := sub.ReceiveDataPoint(request(i))
+				So(err, ShouldBeNil)
+				So(response.Success, ShouldBeTrue)
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- shutdownSubscriber(sub, time.Second, nil) }()
+			for !sub.isClosing() {
+				time.Sleep(time.Millisecond)
+			}
+			close(gate)
+			So(<-done, ShouldBeNil)
+
+			Convey("Then every acknowledged write should have reached the database", nil)
+			So(upserts(), ShouldEqual, 3)
+
+			Convey("Then the run should succeed", nil)
+			So(lastExec(fake, updateRunSQL).args[1], ShouldEqual, runSucceeded)
+
+			Convey("Then later requests should be rejected", nil)
+			_, err := sub.ReceiveDataPoint(request(4))
+			So(err, ShouldEqual, errShuttingDown)
+			_, err = sub.Init(protocol.InitRequest{})
+			So(err, ShouldEqual, errShuttingDown)
+			_, err = sub.DiscoverShapes(protocol.DiscoverShapesRequest{})
+			So(err, ShouldEqual, errShuttingDown)
+			_, err = sub.TestConnection(protocol.TestConnectionRequest{})
+			So(err, ShouldEqual, errShuttingDown)
+			_, err = sub.Dispose(protocol.DisposeRequest{})
+			So(err, ShouldEqual, errShuttingDown)
+			So(upserts(), ShouldEqual, 3)
+		})
+
+		Convey("When a request waits for the lock while it's shut down", func() {
+			sub.mu.RLock()
+			done := make(chan error, 1)
+			go func() { done <- shutdownSubscriber(sub, time.Second, nil) }()
+			for !sub.isClosing() {
+				time.Sleep(time.Millisecond)
+			}
+			initErr := make(chan error, 1)
+			go func() {
+				_, err := sub.Init(protocol.InitRequest{})
+				initErr <- err
+			}()
+			sub.mu.RUnlock()
+			So(<-done, ShouldBeNil)
+
+			Convey("Then it should be rejected once it gets the lock", nil)
+			So(<-initErr, ShouldEqual, errShuttingDown)
+		})
+
+		Convey("When a request is in flight", func() {
+			sub.mu.RLock()
+
+			Convey("Then shutdown should wait for it until the deadline", nil)
+			err := shutdownSubscriber(sub, 20*time.Millisecond, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "shutdown didn't finish within 20ms")
+
+			Convey("Then the subscriber should not be ready", nil)
+			health := newHealthChecker(sub, 0, 0)
+			So(health.readiness().Success, ShouldBeFalse)
+
+			sub.mu.RUnlock()
+		})
+	})
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"fmt"
 	"regexp"
 	"sort"
 	"strconv"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/pipeline-subscribers/shapeutils"
+	"github.com/sirupsen/logrus"
 )
 
 const MySQLTimeFormat = "2006-01-02 15:04:05"
@@ -32,16 +34,30 @@ const alterTemplateText = `ALTER TABLE {{tick .Name}}{{range $i, $e := .Columns}
 const upsertTemplateText = `INSERT INTO {{tick .Name}} ({{range $i, $e := .Columns}}{{tick $e.Name}}, {{end}}
 	{{tick "naveegoPublisher"}}, {{tick "naveegoPublishedAt"}}, {{tick "naveegoShapeVersion"}})
 	VALUES ({{range $i, $e := .Columns}}?, {{end}}?, ?, ?)
-	ON DUPLICATE KEY UPDATE{{range $i, $e := .NonKeyColumns}}{{if not $e.IsKey}}
-		{{tick $e.Name}} = VALUES({{tick $e.Name}}),{{end}}{{end}}
-		{{tick "naveegoPublisher"}} = VALUES({{tick "naveegoPublisher"}}),
-		{{tick "naveegoPublishedAt"}} = VALUES({{tick "naveegoPublishedAt"}}),
-		{{tick "naveegoShapeVersion"}} = VALUES({{tick "naveegoShapeVersion"}});`
+	ON DUPLICATE KEY UPDATE{{range $i, $e := .Updates}}{{if $i}},{{end}}
+		{{tick $e.Column}} = {{$e.Value}}{{end}};`
+
+// mysqlAlterTemplateText is used for servers without ADD COLUMN IF NOT EXISTS;
+// the columns which already exist are filtered out before rendering.
+const mysqlAlterTemplateText = `ALTER TABLE {{tick .Name}}{{range $i, $e := .Columns}}
+	{{if $i}},{{end}}ADD COLUMN {{tick $e.Name}} {{$e.SqlType}} {{if $e.IsKey}}NOT {{end}}NULL{{end}}{{if gt (len .Keys) 0}}
+	{{if .Columns}},{{end}}DROP PRIMARY KEY
+	,ADD PRIMARY KEY ({{jointick .Keys}}){{end}};`
+
+// mysqlAliasUpsertTemplateText uses a row alias instead of the VALUES() function,
+// which is deprecated as of MySQL 8.0.20.
+const mysqlAliasUpsertTemplateText = `INSERT INTO {{tick .Name}} ({{range $i, $e := .Columns}}{{tick $e.Name}}, {{end}}
+	{{tick "naveegoPublisher"}}, {{tick "naveegoPublishedAt"}}, {{tick "naveegoShapeVersion"}})
+	VALUES ({{range $i, $e := .Columns}}?, {{end}}?, ?, ?) AS new
+	ON DUPLICATE KEY UPDATE{{range $i, $e := .Updates}}{{if $i}},{{end}}
+		{{tick $e.Column}} = {{$e.Value}}{{end}};`
 
 var (
-	alterTemplate  *template.Template
-	createTemplate *template.Template
-	upsertTemplate *template.Template
+	alterTemplate            *template.Template
+	createTemplate           *template.Template
+	upsertTemplate           *template.Template
+	mysqlAlterTemplate       *template.Template
+	mysqlAliasUpsertTemplate *template.Template
 )
 
 func init() {
@@ -62,14 +78,123 @@ func init() {
 		Funcs(funcs).
 		Parse(upsertTemplateText))
 
+	mysqlAlterTemplate = template.Must(template.New("mysqlAlter").
+		Funcs(funcs).
+		Parse(mysqlAlterTemplateText))
+
+	mysqlAliasUpsertTemplate = template.Must(template.New("mysqlAliasUpsert").
+		Funcs(funcs).
+		Parse(mysqlAliasUpsertTemplateText))
+
+}
+
+// sqlOptions are the settings which change the SQL we generate and the values we send.
+// The zero value uses the defaults.
+type sqlOptions struct {
+	Dates              dateOptions
+	InvalidValuePolicy string
+
+	// Coercion is how strictly values are converted to their column's type:
+	// coercionLenient, coercionStrict or coercionOff. "" is lenient.
+	Coercion string
+
+	// VersionColumn turns on the out-of-order guard; see settings.VersionProperty.
+	VersionColumn string
+
+	// Sparse upserts only write the properties present in each data point.
+	Sparse bool
+
+	// MergeRules are the merge rules by property, or by shape/property.
+	MergeRules map[string]string
+
+	// Keyless is the strategy for keying shapes without keys, and ShapeKeys
+	// are the keys declared for them by shape name.
+	Keyless   string
+	ShapeKeys map[string][]string
+}
+
+func newSQLOptions(s *settings) (*sqlOptions, error) {
+	dates, err := newDateOptions(s)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &sqlOptions{
+		Dates:              dates,
+		InvalidValuePolicy: strings.ToLower(s.InvalidValuePolicy),
+		Coercion:           strings.ToLower(s.ValueCoercion),
+		Sparse:             s.SparseUpserts,
+		ShapeKeys:          s.ShapeKeys,
+	}
+
+	if s.OutOfOrderGuard {
+		o.VersionColumn = s.VersionProperty
+		if o.VersionColumn == "" {
+			o.VersionColumn = publishedAtColumn
+		}
+	}
+
+	switch o.InvalidValuePolicy {
+	case "":
+		o.InvalidValuePolicy = invalidValueError
+	case invalidValueNull, invalidValueDeadLetter, invalidValueError:
+	default:
+		return nil, settingsError{"invalidValuePolicy", fmt.Sprintf("%q is not one of null, deadletter or error", s.InvalidValuePolicy)}
+	}
+
+	if o.MergeRules, err = newMergeRules(s.MergeRules); err != nil {
+		return nil, err
+	}
+
+	if o.Keyless, err = newKeylessStrategy(s.KeylessShapes); err != nil {
+		return nil, err
+	}
+
+	switch o.Coercion {
+	case "":
+		o.Coercion = coercionLenient
+	case coercionLenient, coercionStrict, coercionOff:
+	default:
+		return nil, settingsError{"valueCoercion", fmt.Sprintf("%q is not one of lenient, strict or off", s.ValueCoercion)}
+	}
+
+	return o, nil
 }
 
-func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
+// checkFeatures checks that the server supports the options.
+func (o *sqlOptions) checkFeatures(d dialect) error {
+	if err := o.checkMergeRules(d); err != nil {
+		return err
+	}
+	return o.checkKeyless(d)
+}
+
+// sqlType returns the column type for a property.
+func (o *sqlOptions) sqlType(d dialect, property, propertyType string, isKey bool) string {
+	if t, ok := o.surrogateSQLType(property, isKey); ok {
+		return t
+	}
+	if propertyType == "date" {
+		return o.Dates.columnType(property)
+	}
+	return d.SQLType(propertyType, isKey)
+}
+
+// valueError is returned when a value can't be converted to its column's type.
+// It doesn't include the value, which is customer data.
+type valueError struct {
+	Column string
+	Reason string
+}
 
-	var (
-		err error
-		w   = &bytes.Buffer{}
-	)
+func (e *valueError) Error() string {
+	return fmt.Sprintf("invalid value for column %q: %s", e.Column, e.Reason)
+}
+
+// createShapeChangeSQL renders the statement which creates or alters the table for a shape.
+// existingColumns are the columns already in the table; they are only needed by dialects
+// which can't skip existing columns in SQL.
+func createShapeChangeSQL(d dialect, opts *sqlOptions, shapeInfo shapeutils.ShapeDelta, existingColumns map[string]bool) (string, error) {
 
 	model := sqlTableModel{
 		Name: escapeString(shapeInfo.Name),
@@ -82,18 +207,20 @@ func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
 		for _, k := range shapeInfo.PreviousShape.Keys {
 			model.Keys = append(model.Keys, k)
 		}
+		model.Keys = opts.surrogateKeyFirst(model.Keys)
 	}
 
 	for n, t := range shapeInfo.NewProperties {
 		columnModel := sqlColumnModel{
-			Name: escapeString(n),
+			Name:     escapeString(n),
+			Property: n,
 		}
 		for _, k := range model.Keys {
 			if k == n {
 				columnModel.IsKey = true
 			}
 		}
-		columnModel.SqlType = convertToSQLType(t, columnModel.IsKey)
+		columnModel.SqlType = opts.sqlType(d, n, t, columnModel.IsKey)
 
 		model.Columns = append(model.Columns, columnModel)
 	}
@@ -106,17 +233,19 @@ func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
 	}
 
 	if shapeInfo.IsNew {
-		err = createTemplate.Execute(w, model)
-	} else {
-		if !shapeInfo.HasKeyChanges {
-			model.Keys = nil
-		}
-		err = alterTemplate.Execute(w, model)
+		return d.CreateTableSQL(model)
 	}
 
-	command := w.String()
+	if !shapeInfo.HasKeyChanges {
+		model.Keys = nil
+	}
+	return d.AlterTableSQL(model, existingColumns)
+}
 
-	return command, err
+func renderTemplate(t *template.Template, model sqlTableModel) (string, error) {
+	w := &bytes.Buffer{}
+	err := t.Execute(w, model)
+	return w.String(), err
 }
 
 type sqlTableModel struct {
@@ -124,14 +253,29 @@ type sqlTableModel struct {
 	Columns       sqlColumns
 	NonKeyColumns sqlColumns
 	Keys          []string
+
+	// Version is the column compared by the out-of-order guard, if it's on.
+	Version string
+
+	// Updates are the assignments in the ON DUPLICATE KEY UPDATE clause.
+	// They are filled in by the dialect.
+	Updates []sqlAssignment
+}
+
+// sqlAssignment is a column = value assignment in an UPDATE clause.
+type sqlAssignment struct {
+	Column string
+	Value  string
 }
 
 type sqlColumns []sqlColumnModel
 
 type sqlColumnModel struct {
-	Name    string
-	SqlType string
-	IsKey   bool
+	Name     string
+	Property string // The property the column is written from, before it's escaped
+	SqlType  string
+	IsKey    bool
+	Merge    string // The merge rule, for upserts
 }
 
 func (s sqlColumns) Len() int {
@@ -144,35 +288,133 @@ func (s sqlColumns) Less(i, j int) bool {
 	return strings.Compare(s[i].Name, s[j].Name) < 0
 }
 
+// signature identifies the set of columns and which of them are keys,
+// for caching the SQL rendered for them.
+func (s sqlColumns) signature() string {
+	names := make([]string, len(s))
+	for i, c := range s {
+		names[i] = c.Name
+		if c.IsKey {
+			names[i] += "*"
+		}
+	}
+	return strings.Join(names, ",")
+}
+
 const (
-	keyUpsertSQL        = "UpsertSQL"
-	keyParameterOrderer = "ParameterOrder"
+	keyUpsertSQL   = "UpsertSQL"
+	keyColumnTypes = "ColumnTypes" // The declared column types; see columnTypes
 )
 
-func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownShape) (sql string, params []interface{}, err error) {
+func createUpsertSQL(d dialect, opts *sqlOptions, datapoint pipeline.DataPoint, knownShape *shapeutils.KnownShape) (sql string, params []interface{}, err error) {
+
+	model := upsertModel(d, opts, knownShape)
+	if opts.Sparse {
+		model = model.sparse(datapoint)
+	}
+	log := dataPointLog(knownShape.Name, datapoint)
+
+	// The SQL is cached for each set of columns: the shape's columns can change,
+	// and sparse upserts have a statement for each set of properties sent.
+	cacheKey := keyUpsertSQL + ":" + model.Columns.signature()
+	if item, ok := getShapeItem(knownShape, cacheKey); ok {
+		sql = item.(string)
+	} else {
+		// Render the SQL
+		sql, err = d.UpsertSQL(model)
+		if err != nil {
+			return
+		}
 
-	var (
-		// 	gotOrderer bool
-		orderer func(pipeline.DataPoint) []interface{}
-	)
+		setShapeItem(knownShape, cacheKey, sql)
+	}
 
-	// item, gotSQL := knownShape.Get(keyUpsertSQL)
-	// if gotSQL {
-	// 	sql = item.(string)
-	// } else {
+	// The parameters are taken from the model rather than cached with the SQL,
+	// because a sparse upsert's columns depend on the data point.
+	orderer := func(dp pipeline.DataPoint) (p []interface{}, err error) {
+		// Populate the parameter list with values from the datapoint,
+		// in the column order. Every invalid value is reported, not just the first.
+		var invalid valueErrors
+		for _, c := range model.Columns {
+			value, err := opts.columnValue(dp, c.Property, c.IsKey)
+			if err != nil {
+				return nil, err
+			}
+			formattedValue, err := formatValue(log, opts, c.Name, c.SqlType, value)
+			if valueErr, ok := err.(*valueError); ok {
+				invalid = append(invalid, valueErr)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, formattedValue)
+		}
+
+		// set the Naveego system column values as parameters
+		pub, ok := datapoint.Meta["publisher"]
+		if !ok {
+			pub = "UNKNOWN"
+		}
+
+		shapeVer, ok := datapoint.Meta["shapeVersion"]
+		if !ok {
+			shapeVer = "UNKNOWN"
+		}
+
+		formattedPubAt, err := publishedAtValue(log, opts, datapoint)
+		if valueErr, ok := err.(*valueError); ok {
+			invalid = append(invalid, valueErr)
+		} else if err != nil {
+			return nil, err
+		}
+		if len(invalid) > 0 {
+			return nil, invalid
+		}
+
+		p = append(p, truncateString("VARCHAR(1000)", pub))
+		p = append(p, formattedPubAt)
+		p = append(p, truncateString("VARCHAR(50)", shapeVer))
+
+		return p, nil
+	}
+
+	params, err = orderer(datapoint)
+
+	return
+}
+
+// upsertModel returns the model for rendering the upsert statement of a shape.
+func upsertModel(d dialect, opts *sqlOptions, knownShape *shapeutils.KnownShape) sqlTableModel {
 	model := sqlTableModel{
 		Name: escapeString(knownShape.Name),
+		Keys: opts.withoutSurrogateKey(knownShape.Keys),
 	}
+
+	// Values are converted for the columns' declared types when they're known. The
+	// types derived from the shape can differ, e.g. for a BIGINT column after a restart.
+	item, _ := getShapeItem(knownShape, keyColumnTypes)
+	declared, _ := item.(map[string]string)
+
 	for _, p := range knownShape.Properties {
 		columnModel := sqlColumnModel{
-			Name: escapeString(p.Name),
+			Name:     escapeString(p.Name),
+			Property: p.Name,
 		}
 		for _, k := range knownShape.Keys {
 			if k == p.Name {
 				columnModel.IsKey = true
 			}
 		}
-		columnModel.SqlType = convertToSQLType(p.Type, columnModel.IsKey)
+		if opts.serverFilled(p.Name, columnModel.IsKey) {
+			continue
+		}
+		if t, ok := declared[columnModel.Name]; ok {
+			columnModel.SqlType = t
+		} else {
+			columnModel.SqlType = opts.sqlType(d, p.Name, p.Type, columnModel.IsKey)
+		}
+		columnModel.Merge = opts.mergeRule(knownShape.Name, p.Name)
 
 		model.Columns = append(model.Columns, columnModel)
 	}
@@ -185,69 +427,76 @@ func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownS
 		}
 	}
 
-	// Render the SQL
-	w := &bytes.Buffer{}
-	err = upsertTemplate.Execute(w, model)
-	if err != nil {
-		return
-	}
+	model.Version = opts.versionColumn(model)
 
-	sql = w.String()
-	knownShape.Set(keyUpsertSQL, sql)
-	//	}
+	return model
+}
 
-	// item, gotOrderer = knownShape.Get(keyParameterOrderer)
-	// if gotOrderer {
-	// 	orderer = item.(func(pipeline.DataPoint) []interface{})
-	// } else {
-	orderer = func(dp pipeline.DataPoint) (p []interface{}) {
-		// Populate the parameter list with values from the datapoint,
-		// in the column order.
-		for _, c := range model.Columns {
-			value := dp.Data[c.Name]
-			formattedValue := formatValue(c.SqlType, value)
-			p = append(p, formattedValue)
+// sparse returns the model for an upsert which only writes the properties present
+// in dp. A property sent as null is present, and is set to NULL. The keys and the
+// version column are always written.
+func (m sqlTableModel) sparse(dp pipeline.DataPoint) sqlTableModel {
+	var columns, nonKeyColumns sqlColumns
+	for _, c := range m.Columns {
+		_, present := dp.Data[c.Property]
+		if !present && !c.IsKey && c.Name != m.Version {
+			continue
 		}
-
-		// set the Naveego system column values as parameters
-		pub, ok := datapoint.Meta["publisher"]
-		if !ok {
-			pub = "UNKNOWN"
+		columns = append(columns, c)
+		if !c.IsKey {
+			nonKeyColumns = append(nonKeyColumns, c)
 		}
+	}
 
-		pubAt, ok := datapoint.Meta["publishedAt"]
-		if !ok {
-			pubAt = time.Now().UTC().Format(time.RFC3339)
-		}
+	m.Columns = columns
+	m.NonKeyColumns = nonKeyColumns
+	return m
+}
 
-		shapeVer, ok := datapoint.Meta["shapeVersion"]
-		if !ok {
-			shapeVer = "UNKNOWN"
-		}
+// publishedAtValue returns the naveegoPublishedAt parameter for a data point.
+func publishedAtValue(log *logrus.Entry, opts *sqlOptions, dp pipeline.DataPoint) (interface{}, error) {
+	pubAt, ok := dp.Meta["publishedAt"]
+	if !ok {
+		pubAt = time.Now().UTC().Format(time.RFC3339)
+	}
 
-		p = append(p, formatValue("VARCHAR(1000)", pub))
-		p = append(p, formatValue("DATETIME", pubAt))
-		p = append(p, formatValue("VARCHAR(50)", shapeVer))
+	return formatValue(log, opts, publishedAtColumn, sqlTypeDateTime, pubAt)
+}
 
-		return p
+// formatValue converts value to what should be sent for a column of type t.
+// Values which can't be converted are handled according to the invalid value policy;
+// when they're stored as NULL a warning is logged to log, unless it's nil.
+func formatValue(log *logrus.Entry, opts *sqlOptions, column string, t string, value interface{}) (interface{}, error) {
+	if isDateColumnType(t) && value != nil {
+		if date, ok := opts.Dates.parse(value); ok {
+			return opts.Dates.format(t, date), nil
+		}
+		return opts.invalidValue(log, column, fmt.Sprintf("not a recognized date or time for a %s column", t))
 	}
 
-	knownShape.Set(keyParameterOrderer, orderer)
-	//	}
+	value, reason := opts.coerceValue(t, value)
+	if reason != "" {
+		return opts.invalidValue(log, column, reason)
+	}
 
-	params = orderer(datapoint)
+	return truncateString(t, value), nil
+}
 
-	return
+// invalidValue applies the invalid value policy. Values are only replaced with
+// NULL when that's asked for; otherwise the data point fails.
+func (o *sqlOptions) invalidValue(log *logrus.Entry, column, reason string) (interface{}, error) {
+	if o.InvalidValuePolicy != invalidValueNull {
+		return nil, &valueError{Column: column, Reason: reason}
+	}
+	if log != nil {
+		log.WithField("column", column).Warnf("Storing NULL: %s", reason)
+	}
+	return nil, nil
 }
 
-func formatValue(t string, value interface{}) interface{} {
+// truncateString truncates strings to the size of VARCHAR columns.
+func truncateString(t string, value interface{}) interface{} {
 	switch t {
-	case "DATETIME":
-		if dateString, ok := value.(string); ok {
-			if date, err := time.Parse(time.RFC3339, dateString); err == nil {
-				return date.UTC().Format(MySQLTimeFormat)
-			}
-		}
 	case "TEXT":
 		if valueString, ok := value.(string); ok {
 			return valueString
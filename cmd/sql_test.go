@@ -45,6 +45,11 @@ func TestSafeFormat(t *testing.T) {
 
 }
 
+var (
+	mariaDB        = newDialect("10.3.8-MariaDB")
+	defaultOptions = &sqlOptions{}
+)
+
 func TestCreateShapeChangeSQL(t *testing.T) {
 
 	Convey("Given a shape", t, func() {
@@ -66,7 +71,7 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 
 			Convey("Then the SQL should be a CREATE statement", nil)
 
-			actual, err := createShapeChangeSQL(shape)
+			actual, err := createShapeChangeSQL(mariaDB, defaultOptions, shape, nil)
 			So(err, ShouldBeNil)
 			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test" (
 	"date" DATETIME NULL,
@@ -88,7 +93,7 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 			Convey("When there are new keys", func() {
 				shape.HasKeyChanges = true
 				Convey("The the SQL should be an ALTER statement", nil)
-				actual, err := createShapeChangeSQL(shape)
+				actual, err := createShapeChangeSQL(mariaDB, defaultOptions, shape, nil)
 				So(err, ShouldBeNil)
 				So(actual, ShouldEqual, e(`ALTER TABLE "test"
 	ADD COLUMN IF NOT EXISTS "date" DATETIME NULL
@@ -102,7 +107,7 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 
 			Convey("When there are not new keys", func() {
 				Convey("The the SQL should be an ALTER statement", nil)
-				actual, err := createShapeChangeSQL(shape)
+				actual, err := createShapeChangeSQL(mariaDB, defaultOptions, shape, nil)
 				So(err, ShouldBeNil)
 				So(actual, ShouldEqual, e(`ALTER TABLE "test"
 	ADD COLUMN IF NOT EXISTS "date" DATETIME NULL
@@ -147,7 +152,7 @@ func TestCreateUpsertSQL(t *testing.T) {
 
 		Convey("When we generate upsert SQL for the first time", func() {
 			nowDateStr := time.Now().UTC().Format("2006-01-02")
-			actual, params, err := createUpsertSQL(dp, shape)
+			actual, params, err := createUpsertSQL(mariaDB, defaultOptions, dp, shape)
 			Convey("Then there should be no error", nil)
 			So(err, ShouldBeNil)
 			Convey("Then the SQL should be correct", nil)
@@ -167,7 +172,7 @@ func TestCreateUpsertSQL(t *testing.T) {
 			So(params[1], ShouldEqual, expectedLongKeyValue)
 			So(params[2], ShouldEqual, longText)
 			So(params[3], ShouldEqual, "First")
-			So(params[4], ShouldEqual, "2017-10-11")
+			So(params[4], ShouldEqual, "2017-10-11 00:00:00")
 			So(params[5], ShouldEqual, 42.2)
 			So(params[6], ShouldEqual, "UNKNOWN")
 			So(params[7], ShouldStartWith, nowDateStr)
@@ -176,28 +181,477 @@ func TestCreateUpsertSQL(t *testing.T) {
 			// Convey("Then the cache should be populated", func() {
 			// 	_, ok := shape.Get(keyUpsertSQL)
 			// 	So(ok, ShouldBeTrue)
-			// 	_, ok = shape.Get(keyParameterOrderer)
-			// 	So(ok, ShouldBeTrue)
 			// })
 		})
+	})
+}
+
+func TestMySQLDialect(t *testing.T) {
+
+	Convey("Given a shape change on MySQL", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			Name:    "test",
+			NewKeys: []string{"id"},
+			NewProperties: map[string]string{
+				"id":  "integer",
+				"str": "string",
+			},
+		}
+
+		Convey("When some columns already exist", func() {
+			actual, err := createShapeChangeSQL(newDialect("5.7.22-log"), defaultOptions, shape, map[string]bool{"id": true})
+			So(err, ShouldBeNil)
+			Convey("Then only the missing columns should be added", nil)
+			So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	ADD COLUMN "str" VARCHAR(1000) NULL;`))
+		})
+
+		Convey("When all columns already exist", func() {
+			actual, err := createShapeChangeSQL(newDialect("5.7.22-log"), defaultOptions, shape, map[string]bool{"id": true, "str": true})
+			So(err, ShouldBeNil)
+			Convey("Then there should be nothing to do", nil)
+			So(actual, ShouldEqual, "")
+		})
+
+		Convey("When the keys changed", func() {
+			shape.HasKeyChanges = true
+			actual, err := createShapeChangeSQL(newDialect("8.0.21"), defaultOptions, shape, map[string]bool{"id": true, "str": true})
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	DROP PRIMARY KEY
+	,ADD PRIMARY KEY ("id");`))
+		})
+	})
+
+	Convey("Given an upsert on MySQL 8.0.20 or later", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string"},
+			},
+			Data: map[string]interface{}{"ID": 1, "Name": "First"},
+		}
 
-		// Convey("When we generate upsert SQL on a shape we've seen before", func() {
-		// 	expectedParameters := []interface{}{"ok"}
-		// 	expectedSQL := "OK"
-		// 	shape.Set(keyUpsertSQL, expectedSQL)
-		// 	shape.Set(keyParameterOrderer, func(datapoint pipeline.DataPoint) []interface{} {
-		// 		return expectedParameters
-		// 	})
+		actual, _, err := createUpsertSQL(newDialect("8.0.21"), defaultOptions, dp, shapeutils.NewKnownShape(dp))
+		So(err, ShouldBeNil)
+		Convey("Then the row alias should be used instead of VALUES()", nil)
+		So(actual, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Name", 
+	"naveegoPublisher", "naveegoPublishedAt", "naveegoShapeVersion")
+	VALUES (?, ?, ?, ?, ?) AS new
+	ON DUPLICATE KEY UPDATE
+		"Name" = new."Name",
+		"naveegoPublisher" = new."naveegoPublisher",
+		"naveegoPublishedAt" = new."naveegoPublishedAt",
+		"naveegoShapeVersion" = new."naveegoShapeVersion";`))
+	})
+}
+
+func TestOutOfOrderGuard(t *testing.T) {
 
-		// 	actual, params, err := createUpsertSQL(dp, shape)
-		// 	Convey("Then there should be no error", nil)
-		// 	So(err, ShouldBeNil)
-		// 	Convey("Then the cached SQL should be reused", nil)
-		// 	So(actual, ShouldEqual, expectedSQL)
-		// 	Convey("Then the cache parameter orderer should be used", nil)
-		// 	So(params, ShouldResemble, expectedParameters)
-		// })
+	Convey("Given a datapoint with a version property", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Meta:   map[string]string{"publishedAt": "2017-10-11T12:00:00Z"},
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string", "Version:integer"},
+			},
+			Data: map[string]interface{}{"ID": 1, "Name": "First", "Version": 7},
+		}
+
+		Convey("When the guard uses naveegoPublishedAt", func() {
+			opts := &sqlOptions{VersionColumn: publishedAtColumn}
+			actual, _, err := createUpsertSQL(mariaDB, opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+
+			Convey("Then every update should be guarded and naveegoPublishedAt assigned last", nil)
+			So(actual, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Name", "Version", 
+	"naveegoPublisher", "naveegoPublishedAt", "naveegoShapeVersion")
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		"Name" = IF("naveegoPublishedAt" IS NULL OR VALUES("naveegoPublishedAt") IS NULL OR VALUES("naveegoPublishedAt") >= "naveegoPublishedAt", VALUES("Name"), "Name"),
+		"Version" = IF("naveegoPublishedAt" IS NULL OR VALUES("naveegoPublishedAt") IS NULL OR VALUES("naveegoPublishedAt") >= "naveegoPublishedAt", VALUES("Version"), "Version"),
+		"naveegoPublisher" = IF("naveegoPublishedAt" IS NULL OR VALUES("naveegoPublishedAt") IS NULL OR VALUES("naveegoPublishedAt") >= "naveegoPublishedAt", VALUES("naveegoPublisher"), "naveegoPublisher"),
+		"naveegoShapeVersion" = IF("naveegoPublishedAt" IS NULL OR VALUES("naveegoPublishedAt") IS NULL OR VALUES("naveegoPublishedAt") >= "naveegoPublishedAt", VALUES("naveegoShapeVersion"), "naveegoShapeVersion"),
+		"naveegoPublishedAt" = IF("naveegoPublishedAt" IS NULL OR VALUES("naveegoPublishedAt") IS NULL OR VALUES("naveegoPublishedAt") >= "naveegoPublishedAt", COALESCE(VALUES("naveegoPublishedAt"), "naveegoPublishedAt"), "naveegoPublishedAt");`))
+
+			Convey("Then the stale check should compare the stored publishedAt", nil)
+			check, err := staleCheck(mariaDB, opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+			So(check.sql, ShouldEqual, e("SELECT COUNT(*) FROM \"Test.Products\" WHERE \"ID\" = ? AND \"naveegoPublishedAt\" > ?"))
+			So(check.params, ShouldResemble, []interface{}{1, "2017-10-11 12:00:00"})
+		})
+
+		Convey("When the guard uses the version property on MySQL 8.0.20 or later", func() {
+			opts := &sqlOptions{VersionColumn: "Version"}
+			actual, _, err := createUpsertSQL(newDialect("8.0.21"), opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
 
+			Convey("Then the row alias should be compared and the version assigned last", nil)
+			So(actual, ShouldEndWith, e(`
+		"naveegoShapeVersion" = IF("Version" IS NULL OR new."Version" IS NULL OR new."Version" >= "Version", new."naveegoShapeVersion", "naveegoShapeVersion"),
+		"Version" = IF("Version" IS NULL OR new."Version" IS NULL OR new."Version" >= "Version", COALESCE(new."Version", "Version"), "Version");`))
+
+			check, err := staleCheck(newDialect("8.0.21"), opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+			So(check.params, ShouldResemble, []interface{}{1, 7})
+		})
+
+		Convey("When the data point has no version", func() {
+			opts := &sqlOptions{VersionColumn: "Version"}
+			dp.Data["Version"] = nil
+			actual, params, err := createUpsertSQL(newDialect("8.0.21"), opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+			So(params[2], ShouldBeNil)
+
+			Convey("Then the update should be applied and the stored version kept", nil)
+			So(actual, ShouldContainSubstring, e(`"Name" = IF("Version" IS NULL OR new."Version" IS NULL OR new."Version" >= "Version", new."Name", "Name")`))
+			So(actual, ShouldEndWith, e(`"Version" = IF("Version" IS NULL OR new."Version" IS NULL OR new."Version" >= "Version", COALESCE(new."Version", "Version"), "Version");`))
+		})
+
+		Convey("When the guard is off", func() {
+			check, err := staleCheck(mariaDB, defaultOptions, dp, shapeutils.NewKnownShape(dp))
+
+			Convey("Then there should be no stale check", nil)
+			So(err, ShouldBeNil)
+			So(check, ShouldBeNil)
+		})
+	})
+}
+
+func TestSparseUpserts(t *testing.T) {
+
+	Convey("Given a known shape and a sparse data point", t, func() {
+		full := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string", "Price:float"},
+			},
+			Data: map[string]interface{}{"ID": 1, "Name": "First", "Price": 4.5},
+		}
+		shape := shapeutils.NewKnownShape(full)
+
+		partial := full
+		partial.Data = map[string]interface{}{"ID": 1, "Price": nil}
+
+		opts := &sqlOptions{Sparse: true}
+
+		Convey("When the upsert SQL is generated", func() {
+			actual, params, err := createUpsertSQL(mariaDB, opts, partial, shape)
+			So(err, ShouldBeNil)
+
+			Convey("Then only the properties present should be written", nil)
+			So(actual, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Price", 
+	"naveegoPublisher", "naveegoPublishedAt", "naveegoShapeVersion")
+	VALUES (?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		"Price" = VALUES("Price"),
+		"naveegoPublisher" = VALUES("naveegoPublisher"),
+		"naveegoPublishedAt" = VALUES("naveegoPublishedAt"),
+		"naveegoShapeVersion" = VALUES("naveegoShapeVersion");`))
+			So(params[:2], ShouldResemble, []interface{}{1, nil})
+
+			Convey("Then the statement should be cached for the set of properties", nil)
+			_, ok := shape.Get(keyUpsertSQL + ":ID*,Price")
+			So(ok, ShouldBeTrue)
+
+			Convey("Then a data point with every property should get its own statement", nil)
+			actual, _, err = createUpsertSQL(mariaDB, opts, full, shape)
+			So(err, ShouldBeNil)
+			So(actual, ShouldContainSubstring, e(`"Name" = VALUES("Name")`))
+		})
+
+		Convey("When the out-of-order guard is on", func() {
+			opts.VersionColumn = publishedAtColumn
+			actual, _, err := createUpsertSQL(mariaDB, opts, partial, shape)
+			So(err, ShouldBeNil)
+
+			Convey("Then the absent properties should still be left out", nil)
+			So(actual, ShouldNotContainSubstring, e(`"Name"`))
+		})
+	})
+
+	Convey("Given a sparse data point with a property whose name is escaped", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string", "Unit#Price:float"},
+			},
+			Data: map[string]interface{}{"ID": 1, "Unit#Price": 4.5},
+		}
+
+		Convey("When the upsert SQL is generated", func() {
+			actual, params, err := createUpsertSQL(mariaDB, &sqlOptions{Sparse: true}, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+
+			Convey("Then the property should be written to its escaped column", nil)
+			So(actual, ShouldContainSubstring, e(`"UnitPrice" = VALUES("UnitPrice")`))
+			So(actual, ShouldNotContainSubstring, e(`"Name"`))
+			So(params[:2], ShouldResemble, []interface{}{1, 4.5})
+		})
+	})
+}
+
+func TestMergeRules(t *testing.T) {
+
+	Convey("Given a shape with merge rules for its properties", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string", "Seen:integer", "Notes:text"},
+			},
+			Data: map[string]interface{}{"ID": 1, "Name": "First", "Seen": 1, "Notes": "a"},
+		}
+
+		opts, err := newSQLOptions(&settings{MergeRules: map[string]string{
+			"Name":                "Coalesce",
+			"Seen":                "sum",
+			"Notes":               "keepfirst",
+			"Test.Products/Notes": "append",
+		}})
+		So(err, ShouldBeNil)
+
+		Convey("When the upsert SQL is generated", func() {
+			actual, _, err := createUpsertSQL(mariaDB, opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+
+			Convey("Then each property should be merged by its rule, and the shape's rule should win", nil)
+			So(actual, ShouldEndWith, e(`ON DUPLICATE KEY UPDATE
+		"Name" = COALESCE(VALUES("Name"), "Name"),
+		"Notes" = COALESCE(CONCAT("Notes", VALUES("Notes")), "Notes", VALUES("Notes")),
+		"Seen" = COALESCE("Seen" + VALUES("Seen"), "Seen", VALUES("Seen")),
+		"naveegoPublisher" = VALUES("naveegoPublisher"),
+		"naveegoPublishedAt" = VALUES("naveegoPublishedAt"),
+		"naveegoShapeVersion" = VALUES("naveegoShapeVersion");`))
+		})
+
+		Convey("When the out-of-order guard is on", func() {
+			opts.VersionColumn = publishedAtColumn
+			actual, _, err := createUpsertSQL(mariaDB, opts, dp, shapeutils.NewKnownShape(dp))
+			So(err, ShouldBeNil)
+
+			Convey("Then the merged value should be guarded", nil)
+			So(actual, ShouldContainSubstring, e(`"Name" = IF("naveegoPublishedAt" IS NULL OR VALUES("naveegoPublishedAt") IS NULL OR VALUES("naveegoPublishedAt") >= "naveegoPublishedAt", `+
+				`COALESCE(VALUES("Name"), "Name"), "Name")`))
+		})
+	})
+
+	Convey("Given the other merge rules", t, func() {
+		Convey("Then they should be rendered null-safely", func() {
+			So(mergeValue(mergeMax, "c", "new.`c`"), ShouldEqual, "GREATEST(COALESCE(`c`, new.`c`), COALESCE(new.`c`, `c`))")
+			So(mergeValue(mergeMin, "c", "new.`c`"), ShouldEqual, "LEAST(COALESCE(`c`, new.`c`), COALESCE(new.`c`, `c`))")
+			So(mergeValue(mergeAppendArray, "c", "new.`c`"), ShouldEqual, "COALESCE(JSON_MERGE_PRESERVE(`c`, new.`c`), `c`, new.`c`)")
+			So(mergeValue(mergeOverwrite, "c", "new.`c`"), ShouldEqual, "new.`c`")
+		})
+	})
+
+	Convey("Given merge rules which aren't valid", t, func() {
+		Convey("Then unknown rules should be rejected", func() {
+			_, err := newSQLOptions(&settings{MergeRules: map[string]string{"Name": "newest"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then appendarray should be rejected on servers without JSON_MERGE_PRESERVE", func() {
+			opts, err := newSQLOptions(&settings{MergeRules: map[string]string{"Tags": "appendarray"}})
+			So(err, ShouldBeNil)
+			So(opts.checkMergeRules(newDialect("10.2.24-MariaDB")), ShouldNotBeNil)
+			So(opts.checkMergeRules(newDialect("10.3.0-MariaDB")), ShouldBeNil)
+			So(opts.checkMergeRules(newDialect("5.7.21")), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestKeylessShapes(t *testing.T) {
+
+	Convey("Given a new shape without keys", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Events",
+			Source: "Test",
+			Shape:  pipeline.Shape{Properties: []string{"Kind:string", "Count:integer"}},
+			Data:   map[string]interface{}{"Kind": "click", "Count": 2},
+		}
+		delta := shapeutils.ShapeDelta{
+			IsNew:         true,
+			Name:          "Test.Events",
+			NewProperties: map[string]string{"Kind": "string", "Count": "integer"},
+		}
+
+		Convey("When the strategy is none", func() {
+			opts, err := newSQLOptions(&settings{})
+			So(err, ShouldBeNil)
+			opts.addSurrogateKey(&delta)
+
+			Convey("Then the table should have no primary key", nil)
+			So(delta.NewKeys, ShouldBeEmpty)
+			actual, err := createShapeChangeSQL(mariaDB, opts, delta, nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldNotContainSubstring, "PRIMARY KEY")
+		})
+
+		Convey("When the strategy is autoincrement", func() {
+			opts, err := newSQLOptions(&settings{KeylessShapes: "AutoIncrement"})
+			So(err, ShouldBeNil)
+			opts.addSurrogateKey(&delta)
+
+			Convey("Then the table should be keyed by an AUTO_INCREMENT column", nil)
+			actual, err := createShapeChangeSQL(mariaDB, opts, delta, nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldContainSubstring, e(`"naveegoId" BIGINT AUTO_INCREMENT NOT NULL,`))
+			So(actual, ShouldContainSubstring, e(`PRIMARY KEY ("naveegoId")`))
+
+			Convey("Then upserts should leave the key to the server", nil)
+			keyed := dp
+			keyed.Shape = pipeline.Shape{KeyNames: []string{"naveegoId"}, Properties: []string{"Kind:string", "Count:integer", "naveegoId:integer"}}
+			actual, params, err := createUpsertSQL(mariaDB, opts, dp, shapeutils.NewKnownShape(keyed))
+			So(err, ShouldBeNil)
+			So(actual, ShouldStartWith, e(`INSERT INTO "Test.Events" ("Count", "Kind", `))
+			So(actual, ShouldNotContainSubstring, "naveegoId")
+			So(params[:2], ShouldResemble, []interface{}{2, "click"})
+
+			Convey("Then keys added later should follow the surrogate key", nil)
+			later := shapeutils.ShapeDelta{
+				Name:          "Test.Events",
+				NewKeys:       []string{"Kind"},
+				NewProperties: map[string]string{},
+				PreviousShape: pipeline.ShapeDefinition{Keys: []string{"naveegoId"}},
+				HasKeyChanges: true,
+			}
+			actual, err = createShapeChangeSQL(mariaDB, opts, later, nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEndWith, e(`ADD PRIMARY KEY ("naveegoId", "Kind");`))
+		})
+
+		Convey("When the strategy is sequence", func() {
+			opts, err := newSQLOptions(&settings{KeylessShapes: "sequence"})
+			So(err, ShouldBeNil)
+			opts.addSurrogateKey(&delta)
+
+			Convey("Then the key should default to the next value of the sequence", nil)
+			actual, err := createShapeChangeSQL(mariaDB, opts, delta, nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldContainSubstring, e(`"naveegoId" BIGINT DEFAULT NEXT VALUE FOR "naveego_key_sequence" NOT NULL,`))
+
+			Convey("Then it should be rejected on servers without sequences", nil)
+			So(opts.checkFeatures(newDialect("10.2.30-MariaDB")), ShouldNotBeNil)
+			So(opts.checkFeatures(newDialect("10.3.0-MariaDB")), ShouldBeNil)
+			So(opts.checkFeatures(newDialect("8.0.30")), ShouldNotBeNil)
+		})
+
+		Convey("When the strategy is hash", func() {
+			opts, err := newSQLOptions(&settings{KeylessShapes: "hash"})
+			So(err, ShouldBeNil)
+			opts.addSurrogateKey(&delta)
+
+			Convey("Then the table should be keyed by the content hash", nil)
+			actual, err := createShapeChangeSQL(mariaDB, opts, delta, nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldContainSubstring, e(`"naveegoContentHash" CHAR(64) NOT NULL,`))
+			So(actual, ShouldContainSubstring, e(`PRIMARY KEY ("naveegoContentHash")`))
+
+			Convey("Then upserts should write the hash of the record's properties", nil)
+			keyed := dp
+			keyed.Shape = pipeline.Shape{KeyNames: []string{"naveegoContentHash"}, Properties: []string{"Kind:string", "Count:integer", "naveegoContentHash:string"}}
+			shape := shapeutils.NewKnownShape(keyed)
+			_, params, err := createUpsertSQL(mariaDB, opts, dp, shape)
+			So(err, ShouldBeNil)
+			hash, err := contentHash(dp)
+			So(err, ShouldBeNil)
+			So(hash, ShouldHaveLength, 64)
+			So(params, ShouldContain, hash)
+
+			Convey("Then the same record should have the same hash, and another a different one", nil)
+			same := dp
+			same.Shape.Properties = []string{"Count:integer", "Kind:string"}
+			sameHash, _ := contentHash(same)
+			So(sameHash, ShouldEqual, hash)
+			other := dp
+			other.Data = map[string]interface{}{"Kind": "click", "Count": 3}
+			otherHash, _ := contentHash(other)
+			So(otherHash, ShouldNotEqual, hash)
+		})
+	})
+
+	Convey("Given a keyed shape with a property named like a surrogate key", t, func() {
+		dp := pipeline.DataPoint{
+			Entity: "Events",
+			Source: "Test",
+			Shape:  pipeline.Shape{KeyNames: []string{"ID"}, Properties: []string{"ID:integer", "naveegoId:integer", "naveegoContentHash:string"}},
+			Data:   map[string]interface{}{"ID": 1, "naveegoId": 42, "naveegoContentHash": "abc"},
+		}
+		delta := shapeutils.ShapeDelta{
+			IsNew:         true,
+			Name:          "Test.Events",
+			NewKeys:       []string{"ID"},
+			NewProperties: map[string]string{"ID": "integer", "naveegoId": "integer", "naveegoContentHash": "string"},
+		}
+
+		for _, strategy := range []string{"", keylessAutoIncrement, keylessHash} {
+			opts, err := newSQLOptions(&settings{KeylessShapes: strategy})
+			So(err, ShouldBeNil)
+			opts.addSurrogateKey(&delta)
+
+			Convey("Then its columns should be ordinary ones with the strategy \""+strategy+"\"", func() {
+				actual, err := createShapeChangeSQL(mariaDB, opts, delta, nil)
+				So(err, ShouldBeNil)
+				So(actual, ShouldContainSubstring, e(`"naveegoId" INT(10) NULL,`))
+				So(actual, ShouldNotContainSubstring, "AUTO_INCREMENT")
+				So(actual, ShouldNotContainSubstring, "CHAR(64)")
+
+				Convey("Then upserts should write the values sent", nil)
+				actual, params, err := createUpsertSQL(mariaDB, opts, dp, shapeutils.NewKnownShape(dp))
+				So(err, ShouldBeNil)
+				So(actual, ShouldStartWith, e(`INSERT INTO "Test.Events" ("ID", "naveegoContentHash", "naveegoId", `))
+				So(params[:3], ShouldResemble, []interface{}{1, "abc", 42})
+			})
+		}
+	})
+
+	Convey("Given keys declared for a shape", t, func() {
+		opts, err := newSQLOptions(&settings{ShapeKeys: map[string][]string{"Test.Events": {"Kind"}}})
+		So(err, ShouldBeNil)
+
+		dp := pipeline.DataPoint{
+			Entity: "Events",
+			Source: "Test",
+			Shape:  pipeline.Shape{Properties: []string{"Kind:string", "Count:integer"}},
+		}
+
+		Convey("Then they should be used when the shape has no keys", func() {
+			declared, err := opts.declareKeys(dp)
+			So(err, ShouldBeNil)
+			So(declared.Shape.KeyNames, ShouldResemble, []string{"Kind"})
+			So(dp.Shape.KeyNames, ShouldBeEmpty)
+		})
+
+		Convey("Then the shape's own keys should win", func() {
+			dp.Shape.KeyNames = []string{"Count"}
+			declared, err := opts.declareKeys(dp)
+			So(err, ShouldBeNil)
+			So(declared.Shape.KeyNames, ShouldResemble, []string{"Count"})
+		})
+
+		Convey("Then a key which isn't a property should be an error", func() {
+			opts.ShapeKeys["Test.Events"] = []string{"Missing"}
+			_, err := opts.declareKeys(dp)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an unknown keyless strategy", t, func() {
+		Convey("Then it should be rejected", func() {
+			_, err := newSQLOptions(&settings{KeylessShapes: "uuid"})
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
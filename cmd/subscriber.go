@@ -1,34 +1,60 @@
 package cmd
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/naveego/api/pipeline/subscriber"
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/navigator-go/subscribers/protocol"
 	"github.com/naveego/pipeline-subscribers/shapeutils"
 	"github.com/sirupsen/logrus"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+// mariaSubscriber is safe for concurrent requests. mu is held for writing by the requests
+// which open or close the connection, and for reading by the ones which use it.
 type mariaSubscriber struct {
+	mu sync.RWMutex
+
 	db             *sql.DB // The connection to the database
-	tx             *sql.Tx
 	connectionInfo string
+	tlsConfigName  string // The name of the custom TLS configuration registered with the driver, if any
 	knownShapes    shapeutils.ShapeCache
-}
-
-type settings struct {
-	DataSourceName string
+	dialect        dialect
+	options        *sqlOptions
+	settings       *settings
+	retry          retryPolicy
+	summary        *runSummary
+	writers        *writerPool // Set when writes are done in parallel
+	ledgerID       int64       // The run's row in naveego_runs, if it could be recorded
+	shapeLocks     shapeLocks  // Serializes the schema changes for each shape
+	closing        int32       // Set once shutdown starts; requests are rejected from then on
+
+	health atomic.Value // *healthTarget, read by the health checks without the lock; see publishHealth
+
+	deadLetterMu         sync.Mutex
+	deadLetterTableReady bool
 }
 
 func (h *mariaSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Checked under the lock, so a request which waited for the shutdown sees it.
+	if h.isClosing() {
+		return protocol.InitResponse{}, errShuttingDown
+	}
+
 	var (
 		response = protocol.InitResponse{}
 		err      error
@@ -40,19 +66,34 @@ func (h *mariaSubscriber) Init(request protocol.InitRequest) (protocol.InitRespo
 		return response, err
 	}
 
-	// Improves performance of inserts
-	_, err = h.db.Exec("SET @@session.unique_checks = 0;")
-	_, err = h.db.Exec("SET @@session.foreign_key_checks = 0;")
-	if err != nil {
-		return response, err
+	runID := h.settings.RunID
+	if runID == "" {
+		runID = newRunID()
 	}
+	setRunID(runID)
 
-	h.tx, err = h.db.Begin()
+	h.summary = newRunSummary()
+	h.retry = newRetryPolicy(h.settings)
+	h.startRun(runID)
 
-	if err != nil {
-		return response, err
+	if h.settings.Checkpoints {
+		if _, err = h.db.Exec(createCheckpointTableSQL); err != nil {
+			return response, fmt.Errorf("couldn't create checkpoint table: %s", err)
+		}
+	}
+
+	if h.options.Keyless == keylessSequence {
+		if _, err = h.db.Exec(createKeySequenceSQL); err != nil {
+			return response, fmt.Errorf("couldn't create key sequence: %s", err)
+		}
+	}
+
+	if h.settings.ParallelWrites {
+		h.writers = newWriterPool(h.db, h.settings, h.retry, h.summary)
 	}
 
+	h.publishHealth()
+
 	response.Message = h.connectionInfo
 	response.Success = true
 
@@ -61,6 +102,23 @@ func (h *mariaSubscriber) Init(request protocol.InitRequest) (protocol.InitRespo
 
 func (h *mariaSubscriber) Dispose(request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.isClosing() {
+		return protocol.DisposeResponse{}, errShuttingDown
+	}
+
+	return h.dispose()
+}
+
+// dispose ends the run. Every write commits on its own, so there's nothing to
+// commit here; queued writes are finished and their errors reported, and the
+// connection is closed. h.mu must be held for writing.
+func (h *mariaSubscriber) dispose() (protocol.DisposeResponse, error) {
+
+	defer setRunID("")
+
 	if h.db == nil {
 		return protocol.DisposeResponse{
 			Success: true,
@@ -68,46 +126,110 @@ func (h *mariaSubscriber) Dispose(request protocol.DisposeRequest) (protocol.Dis
 		}, nil
 	}
 
-	var err error
+	var writeErr, closeErr error
 
-	if h.tx != nil {
-		err = h.tx.Commit()
-		if err != nil {
-			return protocol.DisposeResponse{
-				Success: true,
-				Message: "Error while committing transaction.",
-			}, err
+	if h.writers != nil {
+		// All queued writes have to finish before we close the connection.
+		writeErr = h.writers.drain()
+		h.writers = nil
+	}
+
+	var problems []string
+	if writeErr != nil {
+		problems = append(problems, fmt.Sprintf("Error while writing: %s.", writeErr))
+	}
+
+	if h.summary != nil {
+		status := runSucceeded
+		if writeErr != nil {
+			status = runFailed
 		}
+		h.finishRun(status, strings.Join(problems, " "))
+		// The run's row is in this connection's database; a later run gets its own.
+		h.ledgerID = 0
+		logrus.WithFields(h.summary.fields()).WithField("status", status).Info("Run summary")
 	}
 
-	err = h.db.Close()
+	closeErr = h.db.Close()
 	h.db = nil
+	h.publishHealth()
 
-	if err != nil {
-		return protocol.DisposeResponse{
-			Success: true,
-			Message: "Error while closing connection.",
-		}, err
+	// The next connection may be to another database, without the dead letter table.
+	h.deadLetterMu.Lock()
+	h.deadLetterTableReady = false
+	h.deadLetterMu.Unlock()
+	metrics.pool.setDB(nil)
+
+	if h.tlsConfigName != "" {
+		mysql.DeregisterTLSConfig(h.tlsConfigName)
+		h.tlsConfigName = ""
+	}
+
+	if closeErr != nil {
+		problems = append(problems, fmt.Sprintf("Error while closing connection: %s.", closeErr))
+	} else {
+		problems = append(problems, "Closed connection.")
+	}
+
+	message := strings.Join(problems, " ")
+	if h.summary != nil {
+		message = fmt.Sprintf("%s %s", message, h.summary)
+	}
+
+	// Report the first error; the message has all of them.
+	err := writeErr
+	if err == nil {
+		err = closeErr
 	}
 
 	return protocol.DisposeResponse{
-		Success: true,
-		Message: "Closed connection.",
-	}, nil
+		Success: err == nil,
+		Message: message,
+	}, err
 }
 
 func (h *mariaSubscriber) TestConnection(request protocol.TestConnectionRequest) (protocol.TestConnectionResponse, error) {
 
-	resp, err := h.Init(protocol.InitRequest{Settings: request.Settings})
+	if h.isClosing() {
+		return protocol.TestConnectionResponse{}, errShuttingDown
+	}
+
+	var (
+		report diagnosticReport
+		conn   *connection
+	)
+
+	settings, err := decodeSettings(request.Settings)
+
+	if err == nil {
+		conn, err = openConnection(settings)
+	}
+
+	if err != nil {
+		report.add("connect", false, "%s", err)
+		report.finish()
+	} else {
+		report = diagnose(conn, settings)
+		conn.close()
+	}
+
+	message, _ := json.Marshal(report)
 
 	return protocol.TestConnectionResponse{
-		Message: resp.Message,
-		Success: resp.Success,
+		Message: string(message),
+		Success: report.Success,
 	}, err
 }
 
 func (h *mariaSubscriber) DiscoverShapes(request protocol.DiscoverShapesRequest) (protocol.DiscoverShapesResponse, error) {
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.isClosing() {
+		return protocol.DiscoverShapesResponse{}, errShuttingDown
+	}
+
 	var (
 		response = protocol.DiscoverShapesResponse{}
 		err      error
@@ -126,61 +248,201 @@ func (h *mariaSubscriber) DiscoverShapes(request protocol.DiscoverShapesRequest)
 
 func (h *mariaSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
 
-	logrus.WithField("request", request).Debug("RecieveDataPoint")
+	logrus.WithFields(logrus.Fields{
+		"source":    request.DataPoint.Source,
+		"entity":    request.DataPoint.Entity,
+		"publisher": request.DataPoint.Meta["publisher"],
+		"data":      request.DataPoint.Data,
+	}).Debug("ReceiveDataPoint")
 
 	var (
 		response   = protocol.ReceiveShapeResponse{}
 		knownShape *shapeutils.KnownShape
-		shapeDelta shapeutils.ShapeDelta
 		ok         bool
 	)
 
-	if h.db == nil {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.isClosing() {
+		return response, errShuttingDown
+	}
+
+	if h.db == nil || h.summary == nil {
 		return response, errors.New("you must call Init before sending data points")
 	}
 
-	knownShape, ok = h.knownShapes.GetKnownShape(request.DataPoint)
+	atomic.AddInt64(&h.summary.Received, 1)
 
-	if !ok {
+	dp, err := h.options.declareKeys(request.DataPoint)
+	if err != nil {
+		return response, err
+	}
+	request.DataPoint = dp
 
-		shapeDelta = h.knownShapes.Analyze(request.DataPoint)
+	knownShape, ok = h.knownShapes.GetKnownShape(request.DataPoint)
 
-		sqlCommand, err := createShapeChangeSQL(shapeDelta)
+	if !ok {
+		knownShape, err = h.changeShape(request)
 		if err != nil {
 			return response, err
 		}
+	}
 
-		logrus.WithField("sql", sqlCommand).Debug("Updating table")
+	metrics.received.WithLabelValues(knownShape.Name).Inc()
+	log := dataPointLog(knownShape.Name, request.DataPoint)
 
-		_, err = h.db.Exec(sqlCommand)
+	upsertCommand, upsertParameters, err := createUpsertSQL(h.dialect, h.options, request.DataPoint, knownShape)
+	if isValueError(err) && h.options.InvalidValuePolicy == invalidValueDeadLetter {
+		return h.deadLetterDataPoint(knownShape.Name, request.DataPoint, err)
+	}
+	if err != nil {
+		h.countFailed(knownShape.Name)
+		return response, err
+	}
+
+	log.WithFields(logrus.Fields{"sql": upsertCommand, "params": upsertParameters}).Debug("Upserting record")
 
+	check, err := staleCheck(h.dialect, h.options, request.DataPoint, knownShape)
+	if err != nil {
+		h.countFailed(knownShape.Name)
+		return response, err
+	}
+
+	statements := []statement{{sql: upsertCommand, params: upsertParameters}}
+	if h.settings.Checkpoints {
+		statements = append(statements, checkpointStatement(h.options, knownShape.Name, request.DataPoint))
+	}
+
+	accumulating := !h.options.idempotent(knownShape)
+
+	if h.writers != nil {
+		err = h.writers.submit(recordKey(request.DataPoint.Data, knownShape.Keys), writeJob{
+			shape:        knownShape.Name,
+			statements:   statements,
+			staleCheck:   check,
+			accumulating: accumulating,
+			log:          log,
+		})
 		if err != nil {
-			logrus.WithField("request", request).WithError(err).WithField("sql", sqlCommand).Error("Error executing command")
+			h.countFailed(knownShape.Name)
 			return response, err
 		}
 
-		knownShape = h.knownShapes.ApplyDelta(shapeDelta)
+		return protocol.ReceiveShapeResponse{
+			Success: true,
+		}, nil
 	}
 
-	upsertCommand, upsertParameters, err := createUpsertSQL(request.DataPoint, knownShape)
+	var result sql.Result
+	start := time.Now()
+	retries, err := h.retry.withLog(log).withoutConnectionRetries(accumulating).do(func() error {
+		var execErr error
+		result, execErr = execBatch(context.Background(), h.db, statements)
+		return execErr
+	})
+	h.summary.addRetries(retries)
+	metrics.retries.WithLabelValues(knownShape.Name).Add(float64(retries))
+
 	if err != nil {
-		return response, err
+		h.countFailed(knownShape.Name)
+		log.WithField("request", request).WithError(err).WithField("sql", upsertCommand).WithField("parameters", upsertParameters).WithField("retries", retries).Error("Error executing upsert")
+
+		return protocol.ReceiveShapeResponse{
+			Success: false,
+		}, err
 	}
 
-	logrus.WithFields(logrus.Fields{"sql": upsertCommand, "params": upsertParameters}).Debug("Upserting record")
+	metrics.wrote(knownShape.Name, result, time.Since(start))
+	h.summary.wrote(knownShape.Name, result)
+	countStale(context.Background(), log, h.db, result, check, h.summary)
 
-	_, err = h.db.Exec(upsertCommand, upsertParameters...)
+	return protocol.ReceiveShapeResponse{
+		Success: true,
+	}, nil
+}
+
+// changeShape creates or alters the table for a data point's shape and adds the shape to the cache.
+func (h *mariaSubscriber) changeShape(request protocol.ReceiveShapeRequest) (*shapeutils.KnownShape, error) {
+
+	// Only one data point changes a shape's table at a time. Another may
+	// have made the change while we waited, so look the shape up again.
+	name := h.knownShapes.Analyze(request.DataPoint).Name
+	unlock := h.shapeLocks.lock(name)
+	defer unlock()
+
+	log := dataPointLog(name, request.DataPoint)
 
+	if knownShape, ok := h.knownShapes.GetKnownShape(request.DataPoint); ok {
+		return knownShape, nil
+	}
+
+	shapeDelta := h.knownShapes.Analyze(request.DataPoint)
+	h.options.addSurrogateKey(&shapeDelta)
+
+	var existing map[string]bool
+	if !shapeDelta.IsNew && !h.dialect.Features().AddColumnIfNotExists {
+		var err error
+		existing, err = existingColumns(h.db, escapeString(shapeDelta.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sqlCommand, err := createShapeChangeSQL(h.dialect, h.options, shapeDelta, existing)
 	if err != nil {
-		logrus.WithField("request", request).WithError(err).WithField("sql", upsertCommand).WithField("parameters", upsertParameters).Error("Error executing upsert")
+		return nil, err
+	}
 
-		return protocol.ReceiveShapeResponse{
-			Success: false,
-		}, err
+	if sqlCommand != "" {
+		log.WithField("sql", sqlCommand).Debug("Updating table")
+
+		_, err = h.db.Exec(sqlCommand)
+
+		if err != nil {
+			log.WithField("request", request).WithError(err).WithField("sql", sqlCommand).Error("Error executing command")
+			return nil, err
+		}
+		metrics.ddl.WithLabelValues(shapeDelta.Name).Inc()
+		h.summary.addDDL(sqlCommand)
+	}
+
+	// The columns the table already had may have other types than the shape says.
+	types, err := columnTypes(h.db, escapeString(shapeDelta.Name))
+	if err != nil {
+		return nil, err
 	}
 
+	knownShape := h.knownShapes.ApplyDelta(shapeDelta)
+	setShapeItem(knownShape, keyColumnTypes, types)
+
+	return knownShape, nil
+}
+
+// countFailed counts a data point of shape which couldn't be written.
+func (h *mariaSubscriber) countFailed(shape string) {
+	h.summary.failed(shape)
+	metrics.failed.WithLabelValues(shape).Inc()
+}
+
+// deadLetterDataPoint moves a data point which can't be written to the dead letter table.
+func (h *mariaSubscriber) deadLetterDataPoint(shape string, dp pipeline.DataPoint, reason error) (protocol.ReceiveShapeResponse, error) {
+	log := dataPointLog(shape, dp)
+
+	err := h.deadLetter(shape, dp, reason)
+	if err != nil {
+		h.countFailed(shape)
+		log.WithError(err).Error("Error writing to dead letter table")
+		return protocol.ReceiveShapeResponse{Success: false}, err
+	}
+
+	atomic.AddInt64(&h.summary.DeadLettered, 1)
+	metrics.deadLettered.WithLabelValues(shape).Inc()
+	log.WithField("reason", reason.Error()).Warn("Data point moved to dead letter table")
+
 	return protocol.ReceiveShapeResponse{
 		Success: true,
+		Message: "Moved to dead letter table: " + reason.Error(),
 	}, nil
 }
 
@@ -192,41 +454,46 @@ func (h *mariaSubscriber) connect(settingsMap map[string]interface{}) error {
 	}
 
 	var (
-		settings = &settings{}
+		settings *settings
+		conn     *connection
 		err      error
-		version  string
-		db       *sql.DB
 	)
 
-	err = mapstructure.Decode(settingsMap, settings)
+	settings, err = decodeSettings(settingsMap)
 	if err != nil {
-		return fmt.Errorf("couldn't decode settings: %s", err)
+		return err
 	}
 
-	if settings.DataSourceName == "" {
-		return errors.New("settings didn't contain DataSourceName key")
+	options, err := newSQLOptions(settings)
+	if err != nil {
+		return err
 	}
 
-	db, err = sql.Open("mysql", settings.DataSourceName)
-
+	conn, err = openConnection(settings)
 	if err != nil {
-		return fmt.Errorf("couldn't open SQL connection: %s", err)
+		return err
 	}
 
-	db.QueryRow("SELECT VERSION()").Scan(&version)
-
-	if len(version) == 0 {
-		return fmt.Errorf("couldn't get data from database server")
+	d := newDialect(conn.version)
+	if err = options.checkFeatures(d); err != nil {
+		conn.close()
+		return err
 	}
 
-	h.connectionInfo = fmt.Sprintf("Connected to: %s", version)
-	h.db = db
+	h.connectionInfo = fmt.Sprintf("Connected to: %s", conn.version)
+	h.dialect = d
+	h.options = options
+	h.db = conn.db
+	metrics.pool.setDB(conn.db)
+	h.tlsConfigName = conn.tlsConfigName
+	h.settings = settings
+	setLogDataValues(settings.LogDataValues)
 	shapes, err := h.getKnownShapes()
 	if err != nil {
 		return err
 	}
 
-	h.knownShapes = shapeutils.NewShapeCacheWithShapes(shapes)
+	h.knownShapes = newLockedShapeCache(shapeutils.NewShapeCacheWithShapes(shapes))
 
 	return nil
 }
@@ -293,6 +560,9 @@ func (h *mariaSubscriber) getKnownShapes() (map[string]*shapeutils.KnownShape, e
 		if err != nil {
 			return shapes, err
 		}
+		if isSystemTable(tableName) {
+			continue
+		}
 		tableNames = append(tableNames, tableName)
 	}
 
@@ -305,6 +575,7 @@ func (h *mariaSubscriber) getKnownShapes() (map[string]*shapeutils.KnownShape, e
 		dp := pipeline.DataPoint{
 			Shape: pipeline.Shape{},
 		}
+		types := map[string]string{}
 
 		for rows.Next() {
 			var (
@@ -324,9 +595,11 @@ func (h *mariaSubscriber) getKnownShapes() (map[string]*shapeutils.KnownShape, e
 				dp.Shape.KeyNames = append(dp.Shape.KeyNames, field)
 			}
 			dp.Shape.Properties = append(dp.Shape.Properties, field+":"+convertFromSQLType(coltype))
+			types[field] = strings.ToUpper(coltype)
 		}
 
 		shape := shapeutils.NewKnownShape(dp)
+		setShapeItem(shape, keyColumnTypes, types)
 
 		shapes[shape.Name] = shape
 	}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestSubscriber returns a subscriber which has been initialized against a fake database.
+func newTestSubscriber(s *settings) (*mariaSubscriber, *fakeDriver) {
+	db, fake := newFakeDB()
+	sub := &mariaSubscriber{
+		db:          db,
+		knownShapes: newLockedShapeCache(shapeutils.NewShapeCache()),
+		dialect:     mariaDB,
+		options:     &sqlOptions{},
+		settings:    s,
+		retry:       newRetryPolicy(s),
+		summary:     newRunSummary(),
+	}
+	sub.publishHealth()
+	return sub, fake
+}
+
+func TestConcurrentReceiveDataPoint(t *testing.T) {
+
+	Convey("Given an initialized subscriber", t, func() {
+		sub, fake := newTestSubscriber(&settings{})
+
+		request := func(id int) protocol.ReceiveShapeRequest {
+			return protocol.ReceiveShapeRequest{
+				DataPoint: pipeline.DataPoint{
+					Source: "Test",
+					Entity: "Products",
+					Shape: pipeline.Shape{
+						KeyNames:   []string{"ID"},
+						Properties: []string{"ID:integer", "Name:string"},
+					},
+					Data: map[string]interface{}{"ID": id, "Name": "Product"},
+				},
+			}
+		}
+
+		Convey("When data points of a new shape are received concurrently", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					sub.ReceiveDataPoint(request(i))
+				}(i)
+			}
+			wg.Wait()
+
+			Convey("Then the table should be created once", nil)
+			creates := 0
+			for _, e := range fake.executed() {
+				if strings.HasPrefix(e.query, "CREATE TABLE") {
+					creates++
+				}
+			}
+			So(creates, ShouldEqual, 1)
+			So(sub.summary.Received, ShouldEqual, 20)
+			So(sub.summary.Failed, ShouldEqual, 0)
+		})
+
+		Convey("When the subscriber is disposed while data points are received", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					sub.ReceiveDataPoint(request(i))
+				}(i)
+			}
+			response, err := sub.Dispose(protocol.DisposeRequest{})
+			wg.Wait()
+
+			Convey("Then it should close cleanly", nil)
+			So(err, ShouldBeNil)
+			So(response.Success, ShouldBeTrue)
+
+			Convey("Then later data points should be rejected", nil)
+			_, err = sub.ReceiveDataPoint(request(21))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestAccumulatingUpsertRetries(t *testing.T) {
+
+	Convey("Given a subscriber and a connection lost while upserting", t, func() {
+		sub, fake := newTestSubscriber(&settings{MaxRetries: 3, RetryBackoff: time.Millisecond})
+
+		attempts := 0
+		fake.fail = func(query string, args []driver.Value) error {
+			if strings.HasPrefix(query, "INSERT INTO `Test.Counters`") {
+				attempts++
+				return mysql.ErrInvalidConn
+			}
+			return nil
+		}
+
+		request := protocol.ReceiveShapeRequest{
+			DataPoint: pipeline.DataPoint{
+				Source: "Test",
+				Entity: "Counters",
+				Shape: pipeline.Shape{
+					KeyNames:   []string{"ID"},
+					Properties: []string{"ID:integer", "Seen:integer"},
+				},
+				Data: map[string]interface{}{"ID": 1, "Seen": 1},
+			},
+		}
+
+		Convey("When a property is summed", func() {
+			sub.options.MergeRules = map[string]string{"Seen": mergeSum}
+			_, err := sub.ReceiveDataPoint(request)
+
+			Convey("Then the upsert should not be replayed, as it may have been applied", nil)
+			So(err, ShouldEqual, mysql.ErrInvalidConn)
+			So(attempts, ShouldEqual, 1)
+		})
+
+		Convey("When every property is overwritten", func() {
+			_, err := sub.ReceiveDataPoint(request)
+
+			Convey("Then the upsert should be retried", nil)
+			So(err, ShouldEqual, mysql.ErrInvalidConn)
+			So(attempts, ShouldEqual, 4)
+		})
+	})
+}
+
+func TestDeclaredColumnTypes(t *testing.T) {
+
+	Convey("Given a subscriber and a table whose columns are wider than its shape says", t, func() {
+		sub, fake := newTestSubscriber(&settings{})
+		fake.rows = func(query string) ([]string, [][]driver.Value) {
+			if !strings.Contains(query, "INFORMATION_SCHEMA.COLUMNS") {
+				return nil, nil
+			}
+			return []string{"COLUMN_NAME", "COLUMN_TYPE"}, [][]driver.Value{
+				{[]byte("ID"), []byte("int(10)")},
+				{[]byte("Total"), []byte("bigint(20)")},
+				{[]byte("Price"), []byte("decimal(30,10)")},
+			}
+		}
+
+		request := protocol.ReceiveShapeRequest{
+			DataPoint: pipeline.DataPoint{
+				Source: "Test",
+				Entity: "Orders",
+				Shape: pipeline.Shape{
+					KeyNames:   []string{"ID"},
+					Properties: []string{"ID:integer", "Total:integer", "Price:number"},
+				},
+				Data: map[string]interface{}{"ID": 1, "Total": "3000000000", "Price": "12345678901234567890.0123456789"},
+			},
+		}
+
+		Convey("When a data point is received", func() {
+			response, err := sub.ReceiveDataPoint(request)
+			So(err, ShouldBeNil)
+			So(response.Success, ShouldBeTrue)
+
+			Convey("Then values should be converted for the declared column types", func() {
+				var args []driver.Value
+				for _, e := range fake.executed() {
+					if strings.HasPrefix(e.query, "INSERT INTO `Test.Orders`") {
+						args = e.args
+					}
+				}
+				So(args, ShouldContain, driver.Value(int64(3000000000)))
+				So(args, ShouldContain, driver.Value("12345678901234567890.0123456789"))
+			})
+		})
+	})
+}
+
+func TestDispose(t *testing.T) {
+
+	Convey("Given an initialized subscriber with a run in the ledger", t, func() {
+		sub, fake := newTestSubscriber(&settings{})
+		sub.startRun("run-1")
+		So(sub.ledgerID, ShouldEqual, 1)
+
+		sub.summary.wrote("Test.Products", fakeResult{})
+		sub.summary.failed("Test.Products")
+		sub.summary.addDDL("CREATE TABLE `Test.Products` ...")
+
+		Convey("When a queued write fails", func() {
+			fake.fail = func(query string, args []driver.Value) error {
+				if query == "UPSERT" {
+					return errors.New("table is full")
+				}
+				return nil
+			}
+			sub.writers = newWriterPool(sub.db, sub.settings, retryPolicy{}, sub.summary)
+			sub.writers.submit("1", writeJob{shape: "Test.Products", statements: []statement{{sql: "UPSERT"}}})
+			response, err := sub.Dispose(protocol.DisposeRequest{})
+
+			Convey("Then Dispose should not report success", nil)
+			So(err, ShouldNotBeNil)
+			So(response.Success, ShouldBeFalse)
+			So(response.Message, ShouldStartWith, "Error while writing: 1 writes failed, the first with: table is full. Closed connection.")
+			So(response.Message, ShouldNotContainSubstring, "commit")
+
+			Convey("Then the run should be recorded as failed", nil)
+			update := lastExec(fake, updateRunSQL)
+			So(update, ShouldNotBeNil)
+			So(update.args[1], ShouldEqual, runFailed)
+		})
+
+		Convey("When dead letters were written", func() {
+			sub.deadLetterTableReady = true
+			_, err := sub.Dispose(protocol.DisposeRequest{})
+			So(err, ShouldBeNil)
+
+			Convey("Then the next connection should create the dead letter table again", nil)
+			sub.db, fake = newFakeDB()
+			So(sub.deadLetter("Test.Products", pipeline.DataPoint{}, errors.New("bad value")), ShouldBeNil)
+			So(lastExec(fake, createDeadLetterTableSQL), ShouldNotBeNil)
+		})
+
+		Convey("When it's disposed and connected again without a new run", func() {
+			_, err := sub.Dispose(protocol.DisposeRequest{})
+			So(err, ShouldBeNil)
+			sub.db, fake = newFakeDB()
+			_, err = sub.Dispose(protocol.DisposeRequest{})
+			So(err, ShouldBeNil)
+
+			Convey("Then the old run should not be updated in the new database", nil)
+			So(lastExec(fake, updateRunSQL), ShouldBeNil)
+		})
+
+		Convey("When everything succeeds", func() {
+			response, err := sub.Dispose(protocol.DisposeRequest{})
+
+			Convey("Then the summary should be in the message", nil)
+			So(err, ShouldBeNil)
+			So(response.Success, ShouldBeTrue)
+			So(response.Message, ShouldStartWith, "Closed connection.")
+			So(response.Message, ShouldContainSubstring, "Test.Products: 1 inserted, 0 updated, 0 unchanged, 0 deleted, 1 failed")
+			So(response.Message, ShouldContainSubstring, "1 schema changes applied.")
+
+			Convey("Then the run should be recorded with its counts and DDL", nil)
+			update := lastExec(fake, updateRunSQL)
+			So(update, ShouldNotBeNil)
+			So(update.args[1], ShouldEqual, runSucceeded)
+			So(update.args[5], ShouldContainSubstring, `"Test.Products":{"inserted":1`)
+			So(update.args[6], ShouldContainSubstring, "CREATE TABLE")
+		})
+	})
+}
+
+// lastExec returns the last execution of query, or nil.
+func lastExec(fake *fakeDriver, query string) *fakeExec {
+	execs := fake.executed()
+	for i := len(execs) - 1; i >= 0; i-- {
+		if execs[i].query == query {
+			return &execs[i]
+		}
+	}
+	return nil
+}
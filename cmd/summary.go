@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runSummary collects statistics about a run, from Init to Dispose.
+type runSummary struct {
+	Received     int64
+	Failed       int64
+	DeadLettered int64
+	Retries      int64
+
+	// Stale counts the writes the out-of-order guard kept from overwriting a newer record.
+	Stale int64
+
+	// LastWrite is when the last write succeeded, in Unix nanoseconds.
+	LastWrite int64
+
+	Started time.Time
+
+	mu     sync.Mutex
+	shapes map[string]*shapeCounts
+	ddl    []string
+}
+
+// shapeCounts are the rows written for a shape. Deleted stays 0
+// until the subscriber applies delete actions.
+type shapeCounts struct {
+	Inserted  int64 `json:"inserted"`
+	Updated   int64 `json:"updated"`
+	Unchanged int64 `json:"unchanged"`
+	Deleted   int64 `json:"deleted"`
+	Failed    int64 `json:"failed"`
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{Started: time.Now()}
+}
+
+// shape returns the counts for shape. r.mu must be held.
+func (r *runSummary) shape(shape string) *shapeCounts {
+	if r.shapes == nil {
+		r.shapes = map[string]*shapeCounts{}
+	}
+	c, ok := r.shapes[shape]
+	if !ok {
+		c = &shapeCounts{}
+		r.shapes[shape] = c
+	}
+	return c
+}
+
+// wrote records a successful write to shape. MySQL reports 1 affected row
+// for an insert, 2 for an update and 0 if the row already had the values.
+func (r *runSummary) wrote(shape string, result sql.Result) {
+	atomic.StoreInt64(&r.LastWrite, time.Now().UnixNano())
+
+	var n int64 = -1
+	if result != nil {
+		n, _ = result.RowsAffected()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.shape(shape)
+	switch n {
+	case 0:
+		c.Unchanged++
+	case 1:
+		c.Inserted++
+	case 2:
+		c.Updated++
+	}
+}
+
+// failed records a data point of shape which couldn't be written.
+func (r *runSummary) failed(shape string) {
+	atomic.AddInt64(&r.Failed, 1)
+
+	r.mu.Lock()
+	r.shape(shape).Failed++
+	r.mu.Unlock()
+}
+
+// addDDL records a schema change.
+func (r *runSummary) addDDL(statement string) {
+	r.mu.Lock()
+	r.ddl = append(r.ddl, statement)
+	r.mu.Unlock()
+}
+
+// shapeCounts returns a copy of the counts for each shape.
+func (r *runSummary) shapeCounts() map[string]shapeCounts {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[string]shapeCounts, len(r.shapes))
+	for name, c := range r.shapes {
+		counts[name] = *c
+	}
+	return counts
+}
+
+// appliedDDL returns the schema changes made in the run.
+func (r *runSummary) appliedDDL() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.ddl...)
+}
+
+func (r *runSummary) lastWrite() time.Time {
+	n := atomic.LoadInt64(&r.LastWrite)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (r *runSummary) deadLettered() int64 {
+	return atomic.LoadInt64(&r.DeadLettered)
+}
+
+func (r *runSummary) addRetries(n int) {
+	atomic.AddInt64(&r.Retries, int64(n))
+}
+
+func (r *runSummary) fields() logrus.Fields {
+	return logrus.Fields{
+		"received":     atomic.LoadInt64(&r.Received),
+		"failed":       atomic.LoadInt64(&r.Failed),
+		"deadLettered": atomic.LoadInt64(&r.DeadLettered),
+		"retries":      atomic.LoadInt64(&r.Retries),
+		"stale":        atomic.LoadInt64(&r.Stale),
+		"shapes":       r.shapeCounts(),
+		"ddl":          len(r.appliedDDL()),
+	}
+}
+
+func (r *runSummary) String() string {
+	s := fmt.Sprintf("Received %d data points, %d failed, %d dead lettered, %d stale, %d retries.",
+		atomic.LoadInt64(&r.Received), atomic.LoadInt64(&r.Failed),
+		atomic.LoadInt64(&r.DeadLettered), atomic.LoadInt64(&r.Stale), atomic.LoadInt64(&r.Retries))
+
+	counts := r.shapeCounts()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var shapes []string
+	for _, name := range names {
+		c := counts[name]
+		shapes = append(shapes, fmt.Sprintf("%s: %d inserted, %d updated, %d unchanged, %d deleted, %d failed",
+			name, c.Inserted, c.Updated, c.Unchanged, c.Deleted, c.Failed))
+	}
+	if len(shapes) > 0 {
+		s += " " + strings.Join(shapes, "; ") + "."
+	}
+
+	if ddl := len(r.appliedDDL()); ddl > 0 {
+		s += fmt.Sprintf(" %d schema changes applied.", ddl)
+	}
+
+	return s
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var tlsConfigCounter int64
+
+func (s *settings) hasCustomTLS() bool {
+	return s.TLSCA != "" || s.TLSCert != "" || s.TLSServerName != "" || s.TLSSkipVerify
+}
+
+// buildTLSConfig creates a tls.Config from the TLS settings.
+func (s *settings) buildTLSConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         s.TLSServerName,
+		InsecureSkipVerify: s.TLSSkipVerify || strings.EqualFold(s.TLSMode, "skip-verify"),
+	}
+
+	if s.TLSCA != "" {
+		pem, err := readPEM(s.TLSCA)
+		if err != nil {
+			return nil, settingsError{"tlsCA", err.Error()}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, settingsError{"tlsCA", "no certificates found in CA bundle"}
+		}
+		tc.RootCAs = pool
+	}
+
+	if s.TLSCert != "" {
+		certPEM, err := readPEM(s.TLSCert)
+		if err != nil {
+			return nil, settingsError{"tlsCert", err.Error()}
+		}
+		keyPEM, err := readPEM(s.TLSKey)
+		if err != nil {
+			return nil, settingsError{"tlsKey", err.Error()}
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, settingsError{"tlsCert", err.Error()}
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// registerTLS registers a custom TLS configuration with the driver, if the settings
+// call for one, and points cfg at it. It returns the name the configuration was
+// registered under, which should be passed to mysql.DeregisterTLSConfig when the
+// connection is closed.
+func (s *settings) registerTLS(cfg *mysql.Config) (string, error) {
+	if !s.hasCustomTLS() {
+		return "", nil
+	}
+
+	if strings.EqualFold(s.TLSMode, "false") {
+		return "", settingsError{"tlsMode", "TLS certificates were configured but tlsMode is false"}
+	}
+
+	tc, err := s.buildTLSConfig()
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("sub-mariadb-%d", atomic.AddInt64(&tlsConfigCounter, 1))
+	err = mysql.RegisterTLSConfig(name, tc)
+	if err != nil {
+		return "", fmt.Errorf("couldn't register TLS configuration: %s", err)
+	}
+
+	cfg.TLSConfig = name
+
+	return name, nil
+}
+
+// readPEM returns value if it is PEM content, otherwise the contents of the file it names.
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// describeTLS reports the TLS version and cipher negotiated for a connection.
+func describeTLS(db *sql.DB) (string, error) {
+	rows, err := db.Query("SHOW STATUS LIKE 'Ssl_%'")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	status := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			return "", err
+		}
+		status[name] = value
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	if status["Ssl_version"] == "" {
+		return "", errors.New("connection is not encrypted")
+	}
+
+	return fmt.Sprintf("TLS: %s, cipher: %s", status["Ssl_version"], status["Ssl_cipher"]), nil
+}
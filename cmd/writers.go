@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWriterShards    = 1
+	defaultWriterQueueSize = 1000
+
+	// defaultWriterConnWait is how long a write waits for a free connection in the pool.
+	defaultWriterConnWait = 30 * time.Second
+
+	// reservedConns are the connections parallel writes leave for the checks
+	// after the writes and for the dead letters, schema changes and ledger
+	// written on ReceiveDataPoint's goroutine; see settings.validatePool.
+	reservedConns = 2
+)
+
+var errWritersStopped = errors.New("the writers have been stopped")
+
+// writeJob is the statements to execute for a data point, in one transaction.
+type writeJob struct {
+	shape      string
+	statements []statement
+
+	// staleCheck, if set, is run when the upsert changes nothing; see countStale.
+	staleCheck *statement
+
+	// accumulating is set when the upsert adds to stored values, so it isn't
+	// retried after a lost connection; see retryPolicy.withoutConnectionRetries.
+	accumulating bool
+
+	log *logrus.Entry
+}
+
+// writerPool executes writes in the background. Each shape gets its own workers,
+// so a slow table doesn't hold up the others. Within a shape, writes are spread
+// over shards by a hash of the record key, which keeps the writes for a key in order.
+// Workers only hold a connection while they execute a write, rather than one
+// for their lifetime: a shape's workers live until Dispose, so dedicated
+// connections would leave the shapes after the first few waiting forever for
+// one once MaxOpenConns is reached.
+type writerPool struct {
+	db        *sql.DB
+	shards    int
+	queueSize int
+	connWait  time.Duration
+	retry     retryPolicy
+	summary   *runSummary
+
+	// mu guards workers and stopped. Submitters are counted in submitting
+	// while they hold it for reading, so drain can wait for the ones sending
+	// jobs before it closes the queues.
+	mu         sync.RWMutex
+	workers    map[string][]*writer
+	stopped    bool
+	submitting sync.WaitGroup
+	wg         sync.WaitGroup
+
+	failures int64
+	errMu    sync.Mutex
+	firstErr error
+}
+
+func newWriterPool(db *sql.DB, s *settings, retry retryPolicy, summary *runSummary) *writerPool {
+	p := &writerPool{
+		db:        db,
+		shards:    s.WriterShards,
+		queueSize: s.WriterQueueSize,
+		connWait:  defaultWriterConnWait,
+		retry:     retry,
+		summary:   summary,
+		workers:   map[string][]*writer{},
+	}
+	if p.shards <= 0 {
+		p.shards = defaultWriterShards
+	}
+	if p.queueSize <= 0 {
+		p.queueSize = defaultWriterQueueSize
+	}
+	return p
+}
+
+// submit queues job for the worker responsible for key in job's shape.
+// It blocks while that worker's queue is full, without holding the lock.
+func (p *writerPool) submit(key string, job writeJob) error {
+	if job.log == nil {
+		job.log = logrus.WithField("shape", job.shape)
+	}
+
+	p.mu.RLock()
+	shard := p.workers[job.shape]
+	for shard == nil && !p.stopped {
+		p.mu.RUnlock()
+		p.startWorkers(job.shape)
+		p.mu.RLock()
+		shard = p.workers[job.shape]
+	}
+	if p.stopped {
+		p.mu.RUnlock()
+		return errWritersStopped
+	}
+	p.submitting.Add(1)
+	p.mu.RUnlock()
+	defer p.submitting.Done()
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard[h.Sum32()%uint32(len(shard))].jobs <- job
+	return nil
+}
+
+func (p *writerPool) startWorkers(shape string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers[shape] != nil || p.stopped {
+		return
+	}
+
+	shard := make([]*writer, p.shards)
+	for i := range shard {
+		shard[i] = &writer{pool: p, jobs: make(chan writeJob, p.queueSize)}
+		p.wg.Add(1)
+		go shard[i].run()
+	}
+	p.workers[shape] = shard
+}
+
+// drain waits for all queued writes to finish and stops the workers.
+// It returns an error if any of the writes failed.
+func (p *writerPool) drain() error {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+
+	// The workers keep taking jobs, so submitters blocked on a full queue get through.
+	p.submitting.Wait()
+
+	p.mu.Lock()
+	for _, shard := range p.workers {
+		for _, w := range shard {
+			close(w.jobs)
+		}
+	}
+	p.workers = map[string][]*writer{}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.firstErr != nil {
+		return fmt.Errorf("%d writes failed, the first with: %s", atomic.LoadInt64(&p.failures), p.firstErr)
+	}
+	return nil
+}
+
+func (p *writerPool) fail(job writeJob, err error) {
+	atomic.AddInt64(&p.failures, 1)
+	p.summary.failed(job.shape)
+	metrics.failed.WithLabelValues(job.shape).Inc()
+
+	p.errMu.Lock()
+	if p.firstErr == nil {
+		p.firstErr = err
+	}
+	p.errMu.Unlock()
+
+	job.log.WithError(err).WithField("statements", job.statements).Error("Error executing upsert")
+}
+
+// recordKey identifies the record a data point writes to, for choosing its shard.
+func recordKey(data map[string]interface{}, keys []string) string {
+	h := fnv.New64a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%v\x00", data[k])
+	}
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// writer executes the jobs for one shard of a shape, in order.
+type writer struct {
+	pool *writerPool
+	jobs chan writeJob
+}
+
+func (w *writer) run() {
+	defer w.pool.wg.Done()
+
+	for job := range w.jobs {
+		var result sql.Result
+		start := time.Now()
+		retries, err := w.pool.retry.withLog(job.log).withoutConnectionRetries(job.accumulating).do(func() error {
+			var execErr error
+			result, execErr = w.exec(job)
+			return execErr
+		})
+		w.pool.summary.addRetries(retries)
+		metrics.retries.WithLabelValues(job.shape).Add(float64(retries))
+
+		if err != nil {
+			w.pool.fail(job, err)
+			continue
+		}
+
+		metrics.wrote(job.shape, result, time.Since(start))
+		w.pool.summary.wrote(job.shape, result)
+		countStale(context.Background(), job.log, w.pool.db, result, job.staleCheck, w.pool.summary)
+	}
+}
+
+// exec executes job on a connection taken from the pool for it. It gives up if
+// no connection is free within connWait rather than block Dispose forever.
+func (w *writer) exec(job writeJob) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.pool.connWait)
+	conn, err := w.pool.db.Conn(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("no connection was free within %s: %s", w.pool.connWait, err)
+	}
+	// A lost connection is discarded by the pool, so a retry gets a fresh one.
+	defer conn.Close()
+
+	return execBatch(context.Background(), conn, job.statements)
+}
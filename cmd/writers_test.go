@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriterPool(t *testing.T) {
+
+	Convey("Given a writer pool with several shards", t, func() {
+		db, fake := newFakeDB()
+		defer db.Close()
+
+		summary := &runSummary{}
+		pool := newWriterPool(db, &settings{WriterShards: 4, WriterQueueSize: 2},
+			retryPolicy{MaxRetries: 1, Backoff: time.Millisecond}, summary)
+
+		Convey("When writes for several keys and shapes are submitted", func() {
+			for i := 0; i < 50; i++ {
+				for _, shape := range []string{"a", "b"} {
+					key := fmt.Sprint(i % 5)
+					pool.submit(key, writeJob{shape: shape, statements: []statement{{sql: "UPSERT " + shape, params: []interface{}{key, int64(i)}}}})
+				}
+			}
+
+			So(pool.drain(), ShouldBeNil)
+
+			Convey("Then all writes should be executed", nil)
+			execs := fake.executed()
+			So(len(execs), ShouldEqual, 100)
+
+			Convey("Then the writes for each key should stay in order", nil)
+			last := map[string]int64{}
+			for _, e := range execs {
+				k := e.query + e.args[0].(string)
+				if previous, ok := last[k]; ok {
+					So(e.args[1].(int64), ShouldBeGreaterThan, previous)
+				}
+				last[k] = e.args[1].(int64)
+			}
+		})
+
+		Convey("When a write fails", func() {
+			fake.fail = func(query string, args []driver.Value) error {
+				if query == "BAD" {
+					return errors.New("boom")
+				}
+				return nil
+			}
+
+			pool.submit("1", writeJob{shape: "a", statements: []statement{{sql: "GOOD"}}})
+			pool.submit("1", writeJob{shape: "a", statements: []statement{{sql: "BAD"}}})
+
+			Convey("Then drain should report it", nil)
+			err := pool.drain()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "1 writes failed")
+			So(summary.Failed, ShouldEqual, 1)
+		})
+
+		Convey("When writes are submitted after drain", func() {
+			So(pool.drain(), ShouldBeNil)
+
+			Convey("Then they should be rejected", nil)
+			So(pool.submit("1", writeJob{shape: "a", statements: []statement{{sql: "UPSERT"}}}), ShouldEqual, errWritersStopped)
+		})
+	})
+
+	Convey("Given a pool with fewer connections than workers", t, func() {
+		db, fake := newFakeDB()
+		defer db.Close()
+		db.SetMaxOpenConns(2)
+
+		summary := &runSummary{}
+		pool := newWriterPool(db, &settings{WriterShards: 2, WriterQueueSize: 1}, retryPolicy{}, summary)
+
+		Convey("When writes for many shapes are submitted", func() {
+			for i := 0; i < 20; i++ {
+				for _, shape := range []string{"a", "b", "c", "d"} {
+					So(pool.submit(fmt.Sprint(i), writeJob{shape: shape, statements: []statement{{sql: "UPSERT " + shape}}}), ShouldBeNil)
+				}
+			}
+
+			Convey("Then the workers should share the connections", nil)
+			So(pool.drain(), ShouldBeNil)
+			So(len(fake.executed()), ShouldEqual, 80)
+		})
+
+		Convey("When every connection is taken", func() {
+			pool.connWait = 20 * time.Millisecond
+			for i := 0; i < 2; i++ {
+				conn, err := db.Conn(context.Background())
+				So(err, ShouldBeNil)
+				defer conn.Close()
+			}
+			pool.submit("1", writeJob{shape: "a", statements: []statement{{sql: "UPSERT"}}})
+
+			Convey("Then the write should fail instead of waiting forever", nil)
+			err := pool.drain()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "no connection was free within 20ms")
+			So(fake.executed(), ShouldBeEmpty)
+		})
+	})
+}
@@ -16,6 +16,14 @@ package main
 
 import "github.com/naveego/plugin-sub-mariadb/cmd"
 
+// version and versionHash are set by goreleaser.
+var (
+	version     = "dev"
+	versionHash = ""
+)
+
 func main() {
+	cmd.Version = version
+	cmd.VersionHash = versionHash
 	cmd.Execute()
 }